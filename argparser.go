@@ -3,19 +3,67 @@ package dispatch
 import (
 	"context"
 	"fmt"
-	"html/template"
 	"io"
 	"iter"
+	"log/slog"
+	"maps"
+	"slices"
 	"strings"
+	"text/template"
+	"text/template/parse"
+	"time"
 )
 
 type RenderedCommand struct {
 	command []string
 	input   string
+	// env holds additional environment variables, as sorted KEY=value pairs
+	env []string
+	// workdir is the directory to run the command in, if not the current directory
+	workdir string
+	// script is the content of the command file, if any
+	script string
+	// key, if set, identifies the job instead of everything above
+	key string
+
+	// the remaining fields control how the job is run, so are not part of its marker
+	timeout        *time.Duration
+	priority       int64
+	retries        int
+	concurrencyKey string
+	// ack is run via acknowledge, with ackParameters, once the job has succeeded
+	ack           string
+	ackParameters []any
+	acknowledge   func(ctx context.Context, statement string, parameters ...any) error
+	// attempts counts the times the job has already been run and failed
+	attempts int
+	// timestamp and index are the job's position in the queue, which it keeps when retried
+	timestamp time.Time
+	index     int64
 }
 
+// LogValue shows the parts of the command which are in use
+func (c RenderedCommand) LogValue() slog.Value {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "{command:%v input:%v", c.command, c.input)
+	if len(c.env) > 0 {
+		fmt.Fprintf(&sb, " env:%v", c.env)
+	}
+	if c.workdir != "" {
+		fmt.Fprintf(&sb, " workdir:%v", c.workdir)
+	}
+	if c.key != "" {
+		fmt.Fprintf(&sb, " key:%v", c.key)
+	}
+	sb.WriteString("}")
+	return slog.StringValue(describeRuntime(sb.String()))
+}
+
+// RenderArgs are the fields of a single record, made available to templates.
+// Values are usually strings, but may be any value decoded from JSON: json.Number,
+// bool, nil, []any or map[string]any.
 type (
-	RenderArgs map[string]string
+	RenderArgs map[string]any
 )
 
 type TemplateArgParser struct {
@@ -27,38 +75,519 @@ type TemplateArgParser struct {
 // until either it runs out of input or the context is cancelled. If a fatal error
 // occurs which prevents continuing to process the data stream, cancel the context and exit.
 // Non-fatal errors should return in an empty command being returned (as well as logging the error)
-type Generator func(context.Context, context.CancelCauseFunc, io.Reader) iter.Seq[RenderArgs]
+// Each record is yielded with its line number in the input, or its position if the
+// input does not have lines, so that problems with it can be traced back to the input.
+type Generator func(context.Context, context.CancelCauseFunc, io.Reader) iter.Seq2[int, RenderArgs]
+
+// NewTemplate parses a single template. Templates are rendered as plain text,
+// as the result is passed directly to the command, without any escaping.
+// missingKey controls what happens when a record lacks a referenced field:
+// "error" fails the render, "zero" renders an empty string and "default"
+// renders "<no value>". The functions in TemplateFuncs are available.
+func NewTemplate(name string, text string, missingKey string) (*template.Template, error) {
+	if missingKey == "" {
+		missingKey = "error"
+	}
+	t, err := template.New(name).Option("missingkey=" + missingKey).Funcs(TemplateFuncs).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	if missingKey == "zero" {
+		// the zero value of a missing interface{} would be rendered as "<no value>",
+		// so explicitly convert every result to text
+		appendToActions(t.Root, "toString")
+	}
+	return t, nil
+}
+
+// appendToActions adds a final function call to every pipeline whose
+// result is written to the output, so {{.x}} becomes {{.x | name}}
+func appendToActions(node parse.Node, name string) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, child := range n.Nodes {
+			appendToActions(child, name)
+		}
+	case *parse.ActionNode:
+		if len(n.Pipe.Decl) > 0 {
+			// assignments do not produce any output
+			return
+		}
+		if identifier, ok := n.Pipe.Cmds[len(n.Pipe.Cmds)-1].Args[0].(*parse.IdentifierNode); ok && (identifier.Ident == name || identifier.Ident == "spread") {
+			// the function is already being called, or the items of a spread list are already text
+			return
+		}
+		identifier := parse.NewIdentifier(name).SetPos(n.Pos)
+		n.Pipe.Cmds = append(n.Pipe.Cmds, &parse.CommandNode{NodeType: parse.NodeCommand, Pos: n.Pos, Args: []parse.Node{identifier}})
+	case *parse.IfNode:
+		appendToActions(n.List, name)
+		appendToActions(n.ElseList, name)
+	case *parse.RangeNode:
+		appendToActions(n.List, name)
+		appendToActions(n.ElseList, name)
+	case *parse.WithNode:
+		appendToActions(n.List, name)
+		appendToActions(n.ElseList, name)
+	}
+}
+
+// FieldUsage describes which fields of the record are referenced by templates
+type FieldUsage struct {
+	// Fields are the top-level fields referenced by name
+	Fields map[string]bool
+	// WholeRecord is set if the record itself is used, such as {{.}}, so
+	// that every field could be referenced
+	WholeRecord bool
+}
+
+// UsedFields reports which fields of the record the templates refer to.
+// Fields used inside range and with blocks, where the meaning of dot has
+// changed, are not included unless referred to via $.
+func UsedFields(templates ...*template.Template) FieldUsage {
+	result := FieldUsage{Fields: make(map[string]bool)}
+	for _, t := range templates {
+		if t != nil {
+			result.walk(t.Root, false)
+		}
+	}
+	return result
+}
+
+func (u *FieldUsage) walk(node parse.Node, nested bool) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, child := range n.Nodes {
+			u.walk(child, nested)
+		}
+	case *parse.ActionNode:
+		u.walk(n.Pipe, nested)
+	case *parse.IfNode:
+		u.walk(n.Pipe, nested)
+		u.walk(n.List, nested)
+		u.walk(n.ElseList, nested)
+	case *parse.RangeNode:
+		u.walk(n.Pipe, nested)
+		u.walk(n.List, true)
+		u.walk(n.ElseList, nested)
+	case *parse.WithNode:
+		u.walk(n.Pipe, nested)
+		u.walk(n.List, true)
+		u.walk(n.ElseList, nested)
+	case *parse.TemplateNode:
+		u.walk(n.Pipe, nested)
+	case *parse.PipeNode:
+		if n == nil {
+			return
+		}
+		for _, cmd := range n.Cmds {
+			u.walk(cmd, nested)
+		}
+	case *parse.CommandNode:
+		for _, arg := range n.Args {
+			u.walk(arg, nested)
+		}
+	case *parse.ChainNode:
+		u.walk(n.Node, nested)
+	case *parse.FieldNode:
+		if !nested {
+			u.Fields[n.Ident[0]] = true
+		}
+	case *parse.VariableNode:
+		if n.Ident[0] == "$" {
+			if len(n.Ident) > 1 {
+				u.Fields[n.Ident[1]] = true
+			} else {
+				u.WholeRecord = true
+			}
+		}
+	case *parse.DotNode:
+		if !nested {
+			u.WholeRecord = true
+		}
+	}
+}
+
+// QuoteForShell modifies the templates so that everything they substitute
+// is shell-quoted, while the rest of the template is left unchanged. Values
+// substituted between quotes written in the template are escaped instead,
+// so that "{{.x}}" is still rendered as a single word without extra quotes.
+// Quotes within command substitutions, such as "$(basename '{{.x}}')", are tracked too.
+func QuoteForShell(command []*template.Template) error {
+	// quotes can span the parts of the command, as they are joined into one
+	var context shellContext
+	for _, t := range command {
+		t.Funcs(shellContextFuncs)
+		if err := quoteActions(t.Root, &context); err != nil {
+			return fmt.Errorf("cannot shell-quote %v: %w", t.Root, err)
+		}
+		context = shellQuoteAfter(" ", context)
+	}
+	return nil
+}
+
+// shellContext describes the point in a shell command at which a value is substituted
+type shellContext struct {
+	// open holds the quotes and command substitutions which are open, innermost last.
+	// ( stands for $( or a subshell within one, ` for a backquoted command substitution
+	// and $ for $'...'
+	open string
+	// after is the unescaped \ or $ immediately before this point, if any
+	after rune
+}
+
+// innermost returns the quote or command substitution which most closely encloses the point
+func (c shellContext) innermost() byte {
+	if c.open == "" {
+		return 0
+	}
+	return c.open[len(c.open)-1]
+}
+
+// shellQuoteFuncs quote a value for each kind of shell quote it appears within.
+// Within a command substitution, quoting starts afresh.
+var shellQuoteFuncs = map[byte]string{0: "shellQuote", '(': "shellQuote", '`': "shellQuote", '\'': "shellEscapeSingle", '"': "shellEscapeDouble", '$': "shellEscapeANSI"}
+
+var shellBackquoteEscaper = strings.NewReplacer(`\`, `\\`, "`", "\\`", `$`, `\$`)
+
+// shellContextFuncs are only needed by the templates passed to QuoteForShell
+var shellContextFuncs = template.FuncMap{
+	// shellEscapeANSI makes the value safe to include within $'...'
+	"shellEscapeANSI": stringFunc(strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace),
+	// shellEscapeBackquote protects an already-quoted value from the removal of
+	// backslashes which happens within a backquoted command substitution
+	"shellEscapeBackquote": shellBackquoteEscaper.Replace,
+	// shellAfterBackslash stops a \ written before the value from escaping its first character
+	"shellAfterBackslash": func(s string) string { return `\` + s },
+	// shellAfterDollar stops a $ written before the value from combining with it into
+	// $(...), $'...', ${...} or similar, while still allowing names such as $HOME
+	"shellAfterDollar": func(s string) string {
+		if s != "" && strings.ContainsRune(`('"{[`, rune(s[0])) {
+			return `""` + s
+		}
+		return s
+	},
+}
+
+// quoteActions appends the shell-quoting functions appropriate to each action, tracking
+// the context at that point in the template. The branches of conditionals and loops
+// are assumed to leave the context unchanged.
+func quoteActions(node parse.Node, context *shellContext) error {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return nil
+		}
+		for _, child := range n.Nodes {
+			if err := quoteActions(child, context); err != nil {
+				return err
+			}
+		}
+	case *parse.TextNode:
+		*context = shellQuoteAfter(string(n.Text), *context)
+	case *parse.ActionNode:
+		if len(n.Pipe.Decl) > 0 {
+			// assignments do not produce any output
+			return nil
+		}
+		after := context.after
+		context.after = 0
+		if last := n.Pipe.Cmds[len(n.Pipe.Cmds)-1]; len(last.Args) == 1 {
+			if identifier, ok := last.Args[0].(*parse.IdentifierNode); ok {
+				for _, name := range shellQuoteFuncs {
+					if identifier.Ident == name {
+						// the value is already being quoted
+						return nil
+					}
+				}
+			}
+		}
+		names := []string{shellQuoteFuncs[context.innermost()]}
+		backquotes := strings.Count(context.open, "`")
+		switch {
+		case after != 0 && backquotes > 0:
+			return fmt.Errorf("a value cannot directly follow %c within backquotes; use $(...) instead", after)
+		case after == '\\':
+			names = append(names, "shellAfterBackslash")
+		case after == '$':
+			names = append(names, "shellAfterDollar")
+		}
+		for range backquotes {
+			names = append(names, "shellEscapeBackquote")
+		}
+		for _, name := range names {
+			identifier := parse.NewIdentifier(name).SetPos(n.Pos)
+			n.Pipe.Cmds = append(n.Pipe.Cmds, &parse.CommandNode{NodeType: parse.NodeCommand, Pos: n.Pos, Args: []parse.Node{identifier}})
+		}
+	case *parse.IfNode:
+		return quoteBranches(context, n.List, n.ElseList)
+	case *parse.RangeNode:
+		return quoteBranches(context, n.List, n.ElseList)
+	case *parse.WithNode:
+		return quoteBranches(context, n.List, n.ElseList)
+	}
+	return nil
+}
+
+func quoteBranches(context *shellContext, lists ...*parse.ListNode) error {
+	for _, list := range lists {
+		branchContext := *context
+		if err := quoteActions(list, &branchContext); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-func ParseCommandline(command []string) ([]*template.Template, error) {
+// shellQuoteAfter returns the context after the text, given the one before it
+func shellQuoteAfter(text string, context shellContext) shellContext {
+	open := []byte(context.open)
+	escaped := context.after == '\\'
+	dollar := context.after == '$'
+	for i := 0; i < len(text); i++ {
+		r := text[i]
+		var inner byte
+		if len(open) > 0 {
+			inner = open[len(open)-1]
+		}
+		wasEscaped, afterDollar := escaped, dollar
+		escaped, dollar = false, false
+		switch {
+		case wasEscaped:
+		case inner == '\'':
+			if r == '\'' {
+				open = open[:len(open)-1]
+			}
+		case r == '\\':
+			escaped = true
+		case inner == '$':
+			if r == '\'' {
+				open = open[:len(open)-1]
+			}
+		case afterDollar && r == '(':
+			open = append(open, '(')
+		case afterDollar && r == '\'' && inner != '"':
+			open = append(open, '$')
+		case r == '`':
+			if inner == '`' {
+				open = open[:len(open)-1]
+			} else {
+				open = append(open, '`')
+			}
+		case inner == '"':
+			if r == '"' {
+				open = open[:len(open)-1]
+			}
+			dollar = r == '$'
+		case r == '"' || r == '\'':
+			open = append(open, r)
+		case r == '(' && inner == '(':
+			// a subshell within a command substitution
+			open = append(open, '(')
+		case r == ')' && inner == '(':
+			open = open[:len(open)-1]
+		default:
+			dollar = r == '$'
+		}
+	}
+	result := shellContext{open: string(open)}
+	if escaped {
+		result.after = '\\'
+	} else if dollar {
+		result.after = '$'
+	}
+	return result
+}
+
+func ParseCommandline(command []string, missingKey string) ([]*template.Template, error) {
 	result := make([]*template.Template, len(command))
 	for i, part := range command {
-		if t, err := template.New("ArgParser").Parse(part); err == nil {
-			result[i] = t
-		} else {
+		t, err := NewTemplate("ArgParser", part, missingKey)
+		if err != nil {
+			return nil, err
+		}
+		if err := addSpreadArguments(t); err != nil {
 			return nil, err
 		}
+		result[i] = t
 	}
 	return result, nil
 }
 
+// spreadArguments names the template associated with a command-line argument which
+// consists only of a spread list, such as {{ .values | spread }}. It renders the list
+// with encodeSpread, so that each item can become a separate argument.
+const spreadArguments = "spreadArguments"
+
+func addSpreadArguments(t *template.Template) error {
+	if len(t.Root.Nodes) != 1 {
+		return nil
+	}
+	action, ok := t.Root.Nodes[0].(*parse.ActionNode)
+	if !ok || len(action.Pipe.Decl) > 0 {
+		return nil
+	}
+	if identifier, ok := action.Pipe.Cmds[len(action.Pipe.Cmds)-1].Args[0].(*parse.IdentifierNode); !ok || identifier.Ident != "spread" {
+		return nil
+	}
+	tree := t.Tree.Copy()
+	pipe := tree.Root.Nodes[0].(*parse.ActionNode).Pipe
+	identifier := parse.NewIdentifier(spreadArguments).SetPos(pipe.Pos)
+	pipe.Cmds = append(pipe.Cmds, &parse.CommandNode{NodeType: parse.NodeCommand, Pos: pipe.Pos, Args: []parse.Node{identifier}})
+	_, err := t.Funcs(template.FuncMap{spreadArguments: encodeSpread}).AddParseTree(spreadArguments, tree)
+	return err
+}
+
+// scriptInterpreter returns the command which runs the script: the shell if given,
+// otherwise the interpreter named by its #! line, or sh if there is none. Rather than
+// executing the script file directly, the interpreter is run explicitly, as a newly
+// written file may still be open in a concurrently forked process.
+func scriptInterpreter(script string, shell string) []string {
+	if shell != "" {
+		return []string{shell}
+	}
+	if line, ok := strings.CutPrefix(script, "#!"); ok {
+		line, _, _ = strings.Cut(line, "\n")
+		// like the kernel, treat everything after the interpreter as a single argument
+		interpreter, argument, _ := strings.Cut(strings.TrimSpace(line), " ")
+		if argument = strings.TrimSpace(argument); argument != "" {
+			return []string{interpreter, argument}
+		}
+		if interpreter != "" {
+			return []string{interpreter}
+		}
+	}
+	return []string{"sh"}
+}
+
+// CommandTemplate holds everything which is rendered from each record to produce a job
+type CommandTemplate struct {
+	Command []*template.Template
+	// Script is optional, being rendered into a file which is run with the
+	// rendered Command as its arguments
+	Script *template.Template
+	// Shell, if set, is used to run the command, after joining its parts with spaces,
+	// or to run the script. Whichever is run should already have been passed to QuoteForShell.
+	Shell string
+	// Input is optional, providing the job's STDIN
+	Input *template.Template
+	// Env sets additional environment variables
+	Env []EnvTemplate
+	// WorkDir is optional, setting the directory the command runs in
+	WorkDir *template.Template
+	// Key is optional, identifying the job in place of the rendered command
+	Key *template.Template
+	// EnvFromRecord, if set, is the prefix used to expose every field of the record
+	// as an environment variable
+	EnvFromRecord *string
+	// Ack, if set, is created by NewStatementTemplate, and is rendered and passed
+	// to Acknowledge after the job succeeds
+	Ack         *template.Template
+	Acknowledge func(ctx context.Context, statement string, parameters ...any) error
+}
+
+// Templates returns every template which is rendered for a record
+func (c CommandTemplate) Templates() []*template.Template {
+	result := append([]*template.Template{c.Script, c.Input, c.WorkDir, c.Key, c.Ack}, c.Command...)
+	for _, env := range c.Env {
+		result = append(result, env.Value)
+	}
+	return result
+}
+
 func Render(command []*template.Template, input *template.Template, args RenderArgs) (RenderedCommand, error) {
-	result := RenderedCommand{command: make([]string, 0, len(command))}
-	for _, part := range command {
+	return CommandTemplate{Command: command, Input: input}.Render(args)
+}
+
+func (c CommandTemplate) Render(args RenderArgs) (RenderedCommand, error) {
+	result := RenderedCommand{command: make([]string, 0, len(c.Command))}
+	// when the parts are joined into a single shell command, spread lists are shell-quoted instead
+	joined := c.Script == nil && c.Shell != ""
+	for _, part := range c.Command {
 		var sb strings.Builder
+		if spreading := part.Lookup(spreadArguments); spreading != nil && !joined {
+			if err := spreading.Execute(&sb, args); err != nil {
+				return result, fmt.Errorf("could not render %v with %v: %w", part.Root, args, err)
+			}
+			items, err := decodeSpread(sb.String())
+			if err != nil {
+				return result, err
+			}
+			result.command = append(result.command, items...)
+			continue
+		}
 		err := part.Execute(&sb, args)
 		if err != nil {
-			return result, fmt.Errorf("could not render %v with %q: %w", part, args, err)
+			return result, fmt.Errorf("could not render %v with %v: %w", part.Root, args, err)
 		}
 		result.command = append(result.command, sb.String())
 	}
-	if input != nil {
+	if c.Script != nil {
+		var sb strings.Builder
+		if err := c.Script.Execute(&sb, args); err != nil {
+			return result, fmt.Errorf("could not render the command file with %v: %w", args, err)
+		}
+		result.script = sb.String()
+		// the script is written to a file just before it is run, and is
+		// given the rest of the command as its arguments
+		result.command = append(append(scriptInterpreter(result.script, c.Shell), runtimePlaceholder(scriptField)), result.command...)
+	} else if c.Shell != "" {
+		result.command = []string{c.Shell, "-c", strings.Join(result.command, " ")}
+	}
+	if c.Input != nil {
 		var sb strings.Builder
-		err := input.Execute(&sb, args)
+		err := c.Input.Execute(&sb, args)
 		if err != nil {
-			return result, fmt.Errorf("could not render %v with %q: %w", input, args, err)
+			return result, fmt.Errorf("could not render %v with %v: %w", c.Input.Root, args, err)
 		}
 		result.input = sb.String()
 
 	}
+	if c.Key != nil {
+		var sb strings.Builder
+		if err := c.Key.Execute(&sb, args); err != nil {
+			return result, fmt.Errorf("could not render %v with %v: %w", c.Key.Root, args, err)
+		}
+		if result.key = sb.String(); result.key == "" {
+			return result, fmt.Errorf("the key rendered with %v is empty", args)
+		}
+	}
+	if c.WorkDir != nil {
+		var sb strings.Builder
+		if err := c.WorkDir.Execute(&sb, args); err != nil {
+			return result, fmt.Errorf("could not render %v with %v: %w", c.WorkDir.Root, args, err)
+		}
+		result.workdir = sb.String()
+	}
+	if c.EnvFromRecord != nil || len(c.Env) > 0 {
+		env := make(map[string]string)
+		if c.EnvFromRecord != nil {
+			maps.Copy(env, recordEnv(*c.EnvFromRecord, args))
+		}
+		// explicitly defined variables take precedence over those from the record
+		for _, e := range c.Env {
+			var sb strings.Builder
+			if err := e.Value.Execute(&sb, args); err != nil {
+				return result, fmt.Errorf("could not render environment variable %v with %v: %w", e.Name, args, err)
+			}
+			env[e.Name] = sb.String()
+		}
+		// the environment is part of the marker, so must not depend on the map's ordering
+		for _, name := range slices.Sorted(maps.Keys(env)) {
+			result.env = append(result.env, name+"="+env[name])
+		}
+	}
+	if c.Ack != nil {
+		var err error
+		if result.ack, result.ackParameters, err = RenderStatement(c.Ack, args); err != nil {
+			return result, fmt.Errorf("could not render %v with %v: %w", c.Ack.Root, args, err)
+		}
+		result.acknowledge = c.Acknowledge
+	}
 	return result, nil
 }
@@ -0,0 +1,341 @@
+package dispatch
+
+import (
+	"context"
+	"encoding/json"
+	"iter"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRenderIsNotEscaped(t *testing.T) {
+	templ := Must(ParseCommandline([]string{"echo", "{{.value}}"}, "error"))
+	rendered, err := Render(templ, nil, RenderArgs{"value": "O'Brien & <sons>"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"echo", "O'Brien & <sons>"}; !reflect.DeepEqual(rendered.command, expected) {
+		t.Errorf("expected %q, got %q", expected, rendered.command)
+	}
+}
+
+func TestRenderMissingKey(t *testing.T) {
+	for missingKey, expected := range map[string]string{"zero": "", "default": "<no value>"} {
+		templ := Must(ParseCommandline([]string{"{{.nmae}}"}, missingKey))
+		rendered, err := Render(templ, nil, RenderArgs{"name": "x"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rendered.command[0] != expected {
+			t.Errorf("missing-key=%v: expected %q, got %q", missingKey, expected, rendered.command[0])
+		}
+	}
+	templ := Must(ParseCommandline([]string{"{{.nmae}}"}, "error"))
+	if _, err := Render(templ, nil, RenderArgs{"name": "x"}); err == nil {
+		t.Error("expected an error when a field is missing")
+	}
+}
+
+func TestRenderFunctions(t *testing.T) {
+	templ := Must(ParseCommandline([]string{
+		`{{ .path | base | trimSuffix ".csv" }}`,
+		`{{ .path | dir }}`,
+		`{{ .name | shellQuote }}`,
+		`{{ .missing | default "fallback" }}`,
+		`{{ .path | regexCapture "/([a-z]+)\\." }}`,
+	}, "zero"))
+	rendered, err := Render(templ, nil, RenderArgs{"path": "data/2024/sales.csv", "name": "O'Brien"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"sales", "data/2024", `'O'\''Brien'`, "fallback", "sales"}; !reflect.DeepEqual(rendered.command, expected) {
+		t.Errorf("expected %q, got %q", expected, rendered.command)
+	}
+}
+
+// collectRecords returns the records yielded by a generator, without their line numbers
+func collectRecords(records iter.Seq2[int, RenderArgs]) []RenderArgs {
+	var result []RenderArgs
+	for _, record := range records {
+		result = append(result, record)
+	}
+	return result
+}
+
+func TestRenderJsonValues(t *testing.T) {
+	records := collectRecords(JsonLineGenerator(context.Background(), nil, strings.NewReader(
+		`{"count": 12345678901234567890, "ratio": 1.50, "ok": true, "meta": {"region": "eu"}, "tags": ["a", "b"]}`+"\n")))
+	if len(records) != 1 {
+		t.Fatalf("expected 1 record, got %v", len(records))
+	}
+	templ := Must(ParseCommandline([]string{
+		"{{.count}}", "{{.ratio}}", "{{.ok}}", "{{.meta.region}}", "{{range .tags}}{{.}};{{end}}", "{{.count | trimPrefix \"123\"}}",
+	}, "error"))
+	rendered, err := Render(templ, nil, records[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	// numbers keep their original text, even when passed to string functions
+	if expected := []string{"12345678901234567890", "1.50", "true", "eu", "a;b;", "45678901234567890"}; !reflect.DeepEqual(rendered.command, expected) {
+		t.Errorf("expected %q, got %q", expected, rendered.command)
+	}
+}
+
+func TestRenderBatch(t *testing.T) {
+	generator := NewBatchGenerator(SimpleLineGenerator, 2, 0)
+	batches := collectRecords(generator(context.Background(), nil, strings.NewReader("a b\nc\nd\n")))
+	if len(batches) != 2 {
+		t.Fatalf("expected 2 batches, got %v", len(batches))
+	}
+	templ := Must(ParseCommandline([]string{"rm", "{{ .values | spread }}"}, "error"))
+	rendered, err := Render(templ, nil, batches[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"rm", "a b", "c"}; !reflect.DeepEqual(rendered.command, expected) {
+		t.Errorf("expected %q, got %q", expected, rendered.command)
+	}
+}
+
+func TestRenderSpread(t *testing.T) {
+	templ := Must(ParseCommandline([]string{"echo", "{{ .list | spread }}", "--opt={{ .list | spread }}", "{{ spread .empty }}", "{{ .value | spread }}"}, "error"))
+	input := Must(NewTemplate("input", "{{ .list | spread }}", "error"))
+	args := RenderArgs{"list": []any{"a\x00b", "", json.Number("3")}, "empty": []any{}, "value": "x\x00y"}
+	rendered, err := Render(templ, input, args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the items are used exactly, whatever they contain, and only become separate arguments on their own
+	if expected := []string{"echo", "a\x00b", "", "3", "--opt=a\x00b  3", "x\x00y"}; !reflect.DeepEqual(rendered.command, expected) {
+		t.Errorf("expected %q, got %q", expected, rendered.command)
+	}
+	if expected := "a\x00b  3"; rendered.input != expected {
+		t.Errorf("expected the input %q, got %q", expected, rendered.input)
+	}
+
+	// missing values are rendered as empty strings, and can still be spread
+	templ = Must(ParseCommandline([]string{"{{ .list | spread }}", "{{ .missing | spread }}"}, "zero"))
+	if rendered, err := Render(templ, nil, args); err != nil {
+		t.Error(err)
+	} else if expected := []string{"a\x00b", "", "3", ""}; !reflect.DeepEqual(rendered.command, expected) {
+		t.Errorf("expected %q, got %q", expected, rendered.command)
+	}
+
+	// the arguments of a command file are not joined, so are spread as usual
+	jobTemplate := CommandTemplate{Command: Must(ParseCommandline([]string{"{{ .list | spread }}"}, "error")), Script: Must(NewTemplate("script", "true", "error")), Shell: "bash"}
+	if rendered, err := jobTemplate.Render(args); err != nil {
+		t.Error(err)
+	} else if expected := []string{"bash", runtimePlaceholder(scriptField), "a\x00b", "", "3"}; !reflect.DeepEqual(rendered.command, expected) {
+		t.Errorf("expected %q, got %q", expected, rendered.command)
+	}
+}
+
+func TestRenderEnv(t *testing.T) {
+	prefix := "DISPATCH_"
+	jobTemplate := CommandTemplate{
+		Command:       Must(ParseCommandline([]string{"true"}, "error")),
+		Env:           []EnvTemplate{Must(ParseEnv("DISPATCH_MODE={{.mode | upper}}", "error"))},
+		EnvFromRecord: &prefix,
+	}
+	rendered, err := jobTemplate.Render(RenderArgs{"mode": "fast", "my-id": "3", indexField: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"DISPATCH_MODE=FAST", "DISPATCH_MY_ID=3"}; !reflect.DeepEqual(rendered.env, expected) {
+		t.Errorf("expected %q, got %q", expected, rendered.env)
+	}
+	withoutEnv := Must(Render(jobTemplate.Command, nil, RenderArgs{}))
+	if Marker(rendered) == Marker(withoutEnv) {
+		t.Error("expected the environment to change the marker")
+	}
+}
+
+func TestRenderShell(t *testing.T) {
+	jobTemplate := CommandTemplate{Command: Must(ParseCommandline([]string{"grep foo {{.file}} | wc -l", "{{.file | shellQuote}}", "{{.list | spread}}"}, "error")), Shell: "sh"}
+	Must0(QuoteForShell(jobTemplate.Command))
+	rendered, err := jobTemplate.Render(RenderArgs{"file": "it's $(rm -rf x).txt", "list": []any{"a b", "c"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"sh", "-c", `grep foo 'it'\''s $(rm -rf x).txt' | wc -l 'it'\''s $(rm -rf x).txt' 'a b' c`}
+	if !reflect.DeepEqual(rendered.command, expected) {
+		t.Errorf("expected %q, got %q", expected, rendered.command)
+	}
+}
+
+func TestRenderShellWithinQuotes(t *testing.T) {
+	jobTemplate := CommandTemplate{Command: Must(ParseCommandline([]string{`echo "{{.x}}" '{{.x}}' {{.x}}`, `"{{.x | shellQuote}}`, `x"`}, "error")), Shell: "sh"}
+	Must0(QuoteForShell(jobTemplate.Command))
+	for _, c := range []struct{ value, expected string }{
+		// values which need no escaping are rendered as they would be without --shell
+		{"value", `echo "value" 'value' value "value x"`},
+		{`it's "$HOME"`, `echo "it's \"\$HOME\"" 'it'\''s "$HOME"' 'it'\''s "$HOME"' "'it'\''s "$HOME"' x"`},
+	} {
+		rendered, err := jobTemplate.Render(RenderArgs{"x": c.value})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rendered.command[2] != c.expected {
+			t.Errorf("expected %q, got %q", c.expected, rendered.command[2])
+		}
+	}
+}
+
+func TestKey(t *testing.T) {
+	jobTemplate := func(command string) CommandTemplate {
+		return CommandTemplate{Command: Must(ParseCommandline([]string{command, "{{.id}}"}, "error")), Key: Must(NewTemplate("Key", "order-{{.id}}", "error"))}
+	}
+	rendered, err := jobTemplate("./fulfil").Render(RenderArgs{"id": "7"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rendered.key != "order-7" {
+		t.Errorf("expected the key to be order-7, not %q", rendered.key)
+	}
+	// only the key identifies the job
+	changed, err := jobTemplate("./fulfil-v2").Render(RenderArgs{"id": "7"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if Marker(rendered) != Marker(changed) {
+		t.Error("expected the marker to depend only on the key")
+	}
+	other, err := jobTemplate("./fulfil").Render(RenderArgs{"id": "8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if Marker(rendered) == Marker(other) {
+		t.Error("expected a different key to change the marker")
+	}
+	if Marker(rendered) == Marker(RenderedCommand{command: rendered.command}) {
+		t.Error("expected the key to change the marker")
+	}
+	if _, err := jobTemplate("./fulfil").Render(RenderArgs{"id": ""}); err != nil {
+		t.Errorf("expected a key with other text not to be empty: %v", err)
+	}
+	empty := CommandTemplate{Command: Must(ParseCommandline([]string{"true"}, "error")), Key: Must(NewTemplate("Key", "{{.id}}", "error"))}
+	if _, err := empty.Render(RenderArgs{"id": ""}); err == nil {
+		t.Error("expected an empty key to be refused")
+	}
+}
+
+func TestScriptInterpreter(t *testing.T) {
+	for _, c := range []struct {
+		script, shell string
+		expected      []string
+	}{
+		{"#!/usr/bin/env bash\necho hi\n", "", []string{"/usr/bin/env", "bash"}},
+		{"#!/usr/bin/env -S python3 -u\nprint(1)\n", "", []string{"/usr/bin/env", "-S python3 -u"}},
+		{"#! /bin/bash\r\necho hi\r\n", "", []string{"/bin/bash"}},
+		{"#!/usr/bin/python3", "", []string{"/usr/bin/python3"}},
+		{"echo hi\n", "", []string{"sh"}},
+		{"#!\necho hi\n", "", []string{"sh"}},
+		{" #!/bin/bash\n", "", []string{"sh"}},
+		{"#!/usr/bin/env python3\n", "bash", []string{"bash"}},
+	} {
+		if interpreter := scriptInterpreter(c.script, c.shell); !reflect.DeepEqual(interpreter, c.expected) {
+			t.Errorf("expected %q run with --shell=%q to be interpreted by %q, not %q", c.script, c.shell, c.expected, interpreter)
+		}
+	}
+}
+
+func TestScriptChangesMarker(t *testing.T) {
+	marker := func(script string) string {
+		jobTemplate := CommandTemplate{Command: Must(ParseCommandline([]string{"{{.x}}"}, "error")), Script: Must(NewTemplate("script", script, "error"))}
+		rendered, err := jobTemplate.Render(RenderArgs{"x": "1"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return Marker(rendered)
+	}
+	if marker("echo {{.x}}") != marker("echo {{.x}}") {
+		t.Error("expected the same script to give the same marker")
+	}
+	for _, other := range []string{"echo {{.x}} ", "#!/bin/bash\necho {{.x}}", "printf {{.x}}"} {
+		if marker(other) == marker("echo {{.x}}") {
+			t.Errorf("expected the script %q to change the marker", other)
+		}
+	}
+}
+
+func TestRenderShellInjection(t *testing.T) {
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("bash is not available")
+	}
+	canary := filepath.Join(t.TempDir(), "canary")
+	payloads := []string{
+		"$(touch " + canary + ")",
+		"`touch " + canary + "`",
+		"'; touch " + canary + "; '",
+		`"; touch ` + canary + `; "`,
+		`\'; touch ` + canary + "; #",
+		`\"; touch ` + canary + "; #",
+		"\\`; touch " + canary + "; #",
+		") ; touch " + canary + "; (",
+		"(touch " + canary + ")",
+		"'$(touch " + canary + ")'",
+	}
+	for _, c := range []struct {
+		command string
+		// prefix is output before the value
+		prefix string
+		// unchecked is set if the output depends on the value
+		unchecked bool
+	}{
+		{`printf %s {{.x}}`, "", false},
+		{`printf %s '{{.x}}'`, "", false},
+		{`printf %s "{{.x}}"`, "", false},
+		{`printf %s $'{{.x}}'`, "", false},
+		{`printf %s "$(printf %s "{{.x}}")"`, "", false},
+		{`printf %s "$(printf %s {{.x}})"`, "", false},
+		{`printf %s "$( (printf %s '{{.x}}') )"`, "", false},
+		{"printf %s \"`printf %s {{.x}}`\"", "", false},
+		{"printf %s \"`printf %s \"{{.x}}\"`\"", "", false},
+		{`printf %s \{{.x}}`, `\`, false},
+		{`printf %s "\{{.x}}"`, `\`, false},
+		{`printf %s ${{.x}}`, "", true},
+		{`printf %s "${{.x}}"`, "", true},
+	} {
+		jobTemplate := CommandTemplate{Command: Must(ParseCommandline([]string{c.command}, "error")), Shell: "bash"}
+		Must0(QuoteForShell(jobTemplate.Command))
+		for _, payload := range payloads {
+			rendered, err := jobTemplate.Render(RenderArgs{"x": payload})
+			if err != nil {
+				t.Fatal(err)
+			}
+			output, err := exec.Command(rendered.command[0], rendered.command[1:]...).Output()
+			if _, statErr := os.Stat(canary); statErr == nil {
+				t.Fatalf("%q substituted into %q ran a command: %q", payload, c.command, rendered.command[2])
+			}
+			if c.unchecked {
+				continue
+			}
+			if err != nil {
+				t.Errorf("%q substituted into %q failed: %v", payload, c.command, err)
+			} else if expected := c.prefix + payload; string(output) != expected {
+				t.Errorf("expected %q substituted into %q to output %q, not %q", payload, c.command, expected, output)
+			}
+		}
+	}
+	if err := QuoteForShell(Must(ParseCommandline([]string{"echo `echo \\{{.x}}`"}, "error"))); err == nil {
+		t.Error("expected a value directly after a backslash within backquotes to be refused")
+	}
+}
+
+func TestUsedFields(t *testing.T) {
+	templ := Must(ParseCommandline([]string{"{{.a}} {{.b.c | upper}}", "{{range .list}}{{.ignored}}{{$.d}}{{end}}", "{{if .e}}{{.__index}}{{end}}"}, "error"))
+	used := UsedFields(templ...)
+	if expected := map[string]bool{"a": true, "b": true, "list": true, "d": true, "e": true, "__index": true}; !reflect.DeepEqual(used.Fields, expected) {
+		t.Errorf("expected %v, got %v", expected, used.Fields)
+	}
+	if used.WholeRecord {
+		t.Error("did not expect the whole record to be used")
+	}
+	if !UsedFields(Must(ParseCommandline([]string{"{{range .list}}{{.}}{{end}}{{.}}"}, "error"))...).WholeRecord {
+		t.Error("expected the whole record to be used")
+	}
+}
@@ -0,0 +1,114 @@
+package dispatch
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"iter"
+	"maps"
+	"os"
+	"strings"
+)
+
+// Axis is a named list of values. Jobs are generated for
+// every combination of the values of all axes.
+type Axis struct {
+	Name   string
+	Values []string
+}
+
+// ParseAxis interprets an axis definition, either as name=a,b,c
+// or as name=@filename, where the file contains one value per line.
+func ParseAxis(spec string) (Axis, error) {
+	name, values, found := strings.Cut(spec, "=")
+	name = strings.TrimSpace(name)
+	if !found || name == "" {
+		return Axis{}, fmt.Errorf("axis %q should look like name=a,b,c or name=@filename", spec)
+	}
+	result := Axis{Name: name}
+	if filename, ok := strings.CutPrefix(values, "@"); ok {
+		f, err := os.Open(filename)
+		if err != nil {
+			return Axis{}, fmt.Errorf("cannot read the values of axis %q: %w", name, err)
+		}
+		defer func() {
+			_ = f.Close()
+		}()
+		var readErr error
+		for _, line := range LineReader(f, '\n', func(err error) { readErr = err }) {
+			if line = strings.TrimSpace(line); line != "" {
+				result.Values = append(result.Values, line)
+			}
+		}
+		if readErr != nil {
+			return Axis{}, fmt.Errorf("cannot read the values of axis %q: %w", name, readErr)
+		}
+	} else {
+		for value := range strings.SplitSeq(values, ",") {
+			if value = strings.TrimSpace(value); value == "" {
+				return Axis{}, fmt.Errorf("axis %q has an empty value", name)
+			}
+			result.Values = append(result.Values, value)
+		}
+	}
+	if len(result.Values) == 0 {
+		return Axis{}, fmt.Errorf("axis %q has no values", name)
+	}
+	return result, nil
+}
+
+// NewAxisGenerator yields a record for every combination of the axes' values.
+// If base is nil, the input is ignored. Otherwise, every record produced by
+// base is combined with every combination of the axes' values.
+func NewAxisGenerator(axes []Axis, base Generator) Generator {
+	return func(ctx context.Context, cancel context.CancelCauseFunc, in io.Reader) iter.Seq2[int, RenderArgs] {
+		return func(yield func(int, RenderArgs) bool) {
+			if base == nil {
+				var position int
+				for record := range combinations(axes, RenderArgs{}) {
+					position++
+					if !yield(position, record) {
+						return
+					}
+				}
+				return
+			}
+			for lineNumber, args := range base(ctx, cancel, in) {
+				for record := range combinations(axes, args) {
+					if !yield(lineNumber, record) {
+						return
+					}
+				}
+			}
+		}
+	}
+}
+
+// combinations yields a copy of args for every combination of the axes'
+// values, with the last axis varying fastest
+func combinations(axes []Axis, args RenderArgs) iter.Seq[RenderArgs] {
+	return func(yield func(RenderArgs) bool) {
+		positions := make([]int, len(axes))
+		for {
+			record := maps.Clone(args)
+			for i, axis := range axes {
+				record[axis.Name] = axis.Values[positions[i]]
+			}
+			if !yield(record) {
+				return
+			}
+			// advance to the next combination, like an odometer
+			i := len(axes) - 1
+			for ; i >= 0; i-- {
+				positions[i]++
+				if positions[i] < len(axes[i].Values) {
+					break
+				}
+				positions[i] = 0
+			}
+			if i < 0 {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package dispatch
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseAxis(t *testing.T) {
+	axis, err := ParseAxis(" size = s, m,l")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if axis.Name != "size" || !slices.Equal(axis.Values, []string{"s", "m", "l"}) {
+		t.Errorf("expected size=[s m l], got %v=%v", axis.Name, axis.Values)
+	}
+
+	filename := filepath.Join(t.TempDir(), "regions")
+	if err := os.WriteFile(filename, []byte("eu\n\n us \n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	axis, err = ParseAxis("region=@" + filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(axis.Values, []string{"eu", "us"}) {
+		t.Errorf("expected the values to be read from the file, got %q", axis.Values)
+	}
+
+	for _, spec := range []string{"size", "=a,b", "size=", "size=a,,b", "size=@" + filepath.Join(t.TempDir(), "missing")} {
+		if _, err := ParseAxis(spec); err == nil {
+			t.Errorf("expected %q to be invalid", spec)
+		}
+	}
+}
+
+func TestAxisGenerator(t *testing.T) {
+	axes := []Axis{{Name: "a", Values: []string{"1", "2"}}, {Name: "b", Values: []string{"x", "y"}}}
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+
+	var combined []string
+	for _, record := range NewAxisGenerator(axes, nil)(ctx, cancel, nil) {
+		combined = append(combined, record["a"].(string)+record["b"].(string))
+	}
+	if expected := []string{"1x", "1y", "2x", "2y"}; !slices.Equal(combined, expected) {
+		t.Errorf("expected %v, got %v", expected, combined)
+	}
+
+	combined = nil
+	for _, record := range NewAxisGenerator(axes[1:], NewSimpleLineGenerator('\n', true))(ctx, cancel, strings.NewReader("p\nq\n")) {
+		combined = append(combined, record["value"].(string)+record["b"].(string))
+	}
+	if expected := []string{"px", "py", "qx", "qy"}; !slices.Equal(combined, expected) {
+		t.Errorf("expected every record to be combined with every value, got %v", combined)
+	}
+}
@@ -0,0 +1,68 @@
+package dispatch
+
+import (
+	"context"
+	"io"
+	"iter"
+)
+
+// NewBatchGenerator groups consecutive records into batches, so that a single job
+// can process several records. A batch is complete when it contains size records
+// (unless size is 0), or when adding another record would take the total length of
+// its fields beyond maxBytes (unless maxBytes is 0).
+//
+// Each batch is a record with the fields "records", containing the original records,
+// and "values", containing the "value" field of each of them. It is yielded with the
+// line number of its first record.
+func NewBatchGenerator(generator Generator, size int, maxBytes int) Generator {
+	return func(ctx context.Context, cancel context.CancelCauseFunc, in io.Reader) iter.Seq2[int, RenderArgs] {
+		return func(yield func(int, RenderArgs) bool) {
+			records := make([]any, 0, size)
+			values := make([]any, 0, size)
+			var bytes int
+			var firstLine int
+			flush := func() bool {
+				if len(records) == 0 {
+					return true
+				}
+				batch := RenderArgs{"records": records, "values": values}
+				records = make([]any, 0, size)
+				values = make([]any, 0, size)
+				bytes = 0
+				return yield(firstLine, batch)
+			}
+			for lineNumber, args := range generator(ctx, cancel, in) {
+				recordBytes := recordSize(args)
+				if maxBytes > 0 && bytes+recordBytes > maxBytes {
+					if !flush() {
+						return
+					}
+				}
+				if len(records) == 0 {
+					firstLine = lineNumber
+				}
+				records = append(records, args)
+				if value, ok := args["value"]; ok {
+					values = append(values, value)
+				}
+				bytes += recordBytes
+				if size > 0 && len(records) >= size {
+					if !flush() {
+						return
+					}
+				}
+			}
+			flush()
+		}
+	}
+}
+
+// recordSize estimates how much space a record will take up
+// once it is rendered into a command
+func recordSize(args RenderArgs) int {
+	var result int
+	for _, v := range args {
+		result += len(toString(v))
+	}
+	return result
+}
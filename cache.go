@@ -15,6 +15,10 @@ type Cache interface {
 	FailureModTime(ctx context.Context, marker string) (time.Time, error)
 	ReadSuccess(ctx context.Context, marker string) ([]byte, error)
 	ReadFailure(ctx context.Context, marker string) ([]byte, error)
+	// WriteDescription records the job which was run, for a marker which does not
+	// describe it, such as one derived from --key
+	WriteDescription(ctx context.Context, marker string, data []byte) error
+	ReadDescription(ctx context.Context, marker string) ([]byte, error)
 }
 
 var ErrNotFound = errors.New("not found")
@@ -27,6 +31,7 @@ func NewFileCache(root string) *fileCache {
 	result := &fileCache{root: root}
 	Must0(os.MkdirAll(filepath.Join(root, "success"), 0700))
 	Must0(os.MkdirAll(filepath.Join(root, "failure"), 0700))
+	Must0(os.MkdirAll(filepath.Join(root, "description"), 0700))
 	return result
 }
 
@@ -38,6 +43,10 @@ func (f *fileCache) failurePath(marker string) string {
 	return filepath.Join(f.root, "failure", marker)
 }
 
+func (f *fileCache) descriptionPath(marker string) string {
+	return filepath.Join(f.root, "description", marker)
+}
+
 func (f *fileCache) WriteSuccess(ctx context.Context, marker string, data []byte) error {
 	return os.WriteFile(f.successPath(marker), data, 0644)
 }
@@ -69,3 +78,11 @@ func (f *fileCache) ReadSuccess(ctx context.Context, marker string) ([]byte, err
 func (f *fileCache) ReadFailure(ctx context.Context, marker string) ([]byte, error) {
 	return os.ReadFile(f.failurePath(marker))
 }
+
+func (f *fileCache) WriteDescription(ctx context.Context, marker string, data []byte) error {
+	return os.WriteFile(f.descriptionPath(marker), data, 0644)
+}
+
+func (f *fileCache) ReadDescription(ctx context.Context, marker string) ([]byte, error) {
+	return os.ReadFile(f.descriptionPath(marker))
+}
@@ -8,14 +8,23 @@ import (
 	"strings"
 )
 
-func LineReader(reader io.Reader, cancel context.CancelCauseFunc) iter.Seq[string] {
-	return func(yield func(string) bool) {
+// LineReader yields each non-empty line, along with its line number (starting at 1).
+// Lines are terminated by the delimiter, which is usually '\n'.
+func LineReader(reader io.Reader, delimiter byte, cancel context.CancelCauseFunc) iter.Seq2[int, string] {
+	return func(yield func(int, string) bool) {
 		r := bufio.NewReader(reader)
+		var lineNumber int
 		for {
-			text, err := r.ReadString('\n')
-			text = strings.TrimRight(text, "\n")
+			text, err := r.ReadString(delimiter)
+			lineNumber++
+			// a delimiter of 0x80 or above is a single byte, not a rune
+			text = strings.TrimSuffix(text, string([]byte{delimiter}))
 			if err != nil {
 				if err == io.EOF {
+					// the final line may not have a newline
+					if len(text) > 0 {
+						yield(lineNumber, text)
+					}
 					return
 				}
 				if cancel != nil {
@@ -26,7 +35,7 @@ func LineReader(reader io.Reader, cancel context.CancelCauseFunc) iter.Seq[strin
 			if len(text) == 0 {
 				continue
 			}
-			if !yield(text) {
+			if !yield(lineNumber, text) {
 				return
 			}
 		}
@@ -0,0 +1,17 @@
+package dispatch
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestLineReaderHighDelimiter(t *testing.T) {
+	var lines []string
+	for _, line := range LineReader(strings.NewReader("a\xffb\xff"), 0xff, nil) {
+		lines = append(lines, line)
+	}
+	if expected := []string{"a", "b"}; !slices.Equal(lines, expected) {
+		t.Errorf("expected %q, got %q", expected, lines)
+	}
+}
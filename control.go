@@ -0,0 +1,155 @@
+package dispatch
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Reserved record fields which control how a single job is run,
+// overriding the options given on the command line
+const (
+	timeoutField        = "_timeout"
+	priorityField       = "_priority"
+	retriesField        = "_retries"
+	concurrencyKeyField = "_concurrency_key"
+	inputField          = "_input"
+)
+
+// JobControls are the per-job settings taken from a record's reserved fields
+type JobControls struct {
+	// Timeout overrides --timeout
+	Timeout *time.Duration
+	// Priority causes jobs to run before any with a lower priority (the default is 0)
+	Priority int64
+	// Retries overrides --retries
+	Retries *int
+	// ConcurrencyKey prevents jobs with the same key from running at the same time
+	ConcurrencyKey string
+	// Input overrides the job's STDIN, like --input
+	Input *string
+}
+
+// takeJobControls removes the reserved fields from the record, returning
+// the settings they describe. Timeouts can be given as a duration such as
+// "1m30s", or a number of seconds.
+func takeJobControls(args RenderArgs) (JobControls, error) {
+	var result JobControls
+	if value, ok := args[timeoutField]; ok {
+		var timeout time.Duration
+		if seconds, err := strconv.ParseFloat(toString(value), 64); err == nil {
+			timeout = time.Duration(seconds * float64(time.Second))
+		} else {
+			var d Duration
+			if err := d.UnmarshalFlag(toString(value)); err != nil {
+				return result, fmt.Errorf("%v should be a duration or a number of seconds, not %q", timeoutField, toString(value))
+			}
+			timeout = time.Duration(d)
+		}
+		if timeout <= 0 {
+			return result, fmt.Errorf("%v should be positive, not %q", timeoutField, toString(value))
+		}
+		result.Timeout = &timeout
+	}
+	if value, ok := args[priorityField]; ok {
+		priority, err := controlInt(value)
+		if err != nil {
+			return result, fmt.Errorf("%v should be a whole number, not %q", priorityField, toString(value))
+		}
+		result.Priority = priority
+	}
+	if value, ok := args[retriesField]; ok {
+		retries, err := controlInt(value)
+		if err != nil || retries < 0 {
+			return result, fmt.Errorf("%v should be zero or more, not %q", retriesField, toString(value))
+		}
+		n := int(retries)
+		result.Retries = &n
+	}
+	if value, ok := args[concurrencyKeyField]; ok {
+		result.ConcurrencyKey = toString(value)
+	}
+	if value, ok := args[inputField]; ok {
+		input := toString(value)
+		result.Input = &input
+	}
+	for _, field := range []string{timeoutField, priorityField, retriesField, concurrencyKeyField, inputField} {
+		delete(args, field)
+	}
+	return result, nil
+}
+
+func controlInt(value any) (int64, error) {
+	switch v := value.(type) {
+	case int:
+		return int64(v), nil
+	case int64:
+		return v, nil
+	case json.Number:
+		return v.Int64()
+	default:
+		return strconv.ParseInt(toString(v), 10, 64)
+	}
+}
+
+// apply copies the settings into the rendered command
+func (c JobControls) apply(command *RenderedCommand) {
+	command.timeout = c.Timeout
+	command.priority = c.Priority
+	if c.Retries != nil {
+		command.retries = *c.Retries
+	}
+	command.concurrencyKey = c.ConcurrencyKey
+	if c.Input != nil {
+		command.input = *c.Input
+	}
+}
+
+// keyedMutex allows only one holder of each key at a time. Rather than
+// waiting for a key, callers try to take it, and are notified when any
+// key is released so that they can try again.
+type keyedMutex struct {
+	mutex    sync.Mutex
+	held     map[string]bool
+	released chan struct{}
+}
+
+func newKeyedMutex() *keyedMutex {
+	return &keyedMutex{held: make(map[string]bool), released: make(chan struct{}, 1)}
+}
+
+// TryLock takes the key, unless it is already held
+func (k *keyedMutex) TryLock(key string) bool {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	if k.held[key] {
+		return false
+	}
+	k.held[key] = true
+	return true
+}
+
+// Held reports whether the key is in use
+func (k *keyedMutex) Held(key string) bool {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	return k.held[key]
+}
+
+func (k *keyedMutex) Unlock(key string) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	delete(k.held, key)
+	select {
+	case k.released <- struct{}{}:
+	default:
+		// a notification is already pending
+	}
+}
+
+// Released is notified after a key is released
+func (k *keyedMutex) Released() <-chan struct{} {
+	return k.released
+}
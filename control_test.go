@@ -0,0 +1,42 @@
+package dispatch
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"testing"
+)
+
+func TestSorterDefersJobsWithHeldKeys(t *testing.T) {
+	SetLogger(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	presorted := make(chan UnsortedCommand, 3)
+	postSorted := make(chan RenderedCommand)
+	locks := newKeyedMutex()
+	for i, key := range []string{"a", "a", "b"} {
+		presorted <- UnsortedCommand{command: RenderedCommand{command: []string{key, string(rune('1' + i))}, concurrencyKey: key}, index: int64(i)}
+	}
+	close(presorted)
+	go sorter(ctx, Opts{}, presorted, postSorted, locks)
+
+	// the second job with key a must wait, but should not delay the job with key b
+	if first := <-postSorted; first.command[1] != "1" {
+		t.Fatalf("expected the first job, got %v", first.command)
+	}
+	if second := <-postSorted; second.command[1] != "3" {
+		t.Fatalf("expected the job with key b, got %v", second.command)
+	}
+	if !locks.Held("a") || !locks.Held("b") {
+		t.Error("expected the keys of the jobs which were sent to be held")
+	}
+	locks.Unlock("a")
+	if third := <-postSorted; third.command[1] != "2" {
+		t.Fatalf("expected the second job with key a once the key was released, got %v", third.command)
+	}
+	locks.Unlock("a")
+	locks.Unlock("b")
+	if _, ok := <-postSorted; ok {
+		t.Error("expected no more jobs")
+	}
+}
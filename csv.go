@@ -1,48 +1,153 @@
 package dispatch
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"encoding/csv"
+	"errors"
 	"fmt"
 	"io"
 	"iter"
-	"log/slog"
 	"strings"
 )
 
-func CsvGenerator(ctx context.Context, cancel context.CancelCauseFunc, in io.Reader) iter.Seq[RenderArgs] {
-	r := csv.NewReader(in)
-	return func(yield func(RenderArgs) bool) {
-		header, err := r.Read()
-		if err != nil {
-			logger.Error("oops", slog.Any("error", err))
-			cancel(fmt.Errorf("could not parse the header line of what should be a CSV file: %w", err))
-			return
-		}
-		lineNumber := 0
-		for {
-			lineNumber += 1
-			record, err := r.Read()
-			if err == io.EOF {
-				return
+// Ways of handling CSV rows whose number of columns differs from the header
+const (
+	// RaggedReject passes the row to the rejector
+	RaggedReject = "reject"
+	// RaggedPad fills any missing columns with empty strings, but rejects rows with too many columns
+	RaggedPad = "pad"
+	// RaggedSkip silently ignores the row
+	RaggedSkip = "skip"
+	// RaggedError stops processing the input
+	RaggedError = "error"
+)
+
+// CsvOptions control how CSV input is interpreted. The zero value
+// describes a comma-separated file whose first row is the header.
+type CsvOptions struct {
+	// Columns names the columns of a file which has no header row
+	Columns []string
+	// Comma is the field delimiter, defaulting to a comma
+	Comma rune
+	// Comment causes rows starting with this character to be ignored
+	Comment rune
+	// LazyQuotes allows quotes to appear in unquoted fields, and unescaped in quoted fields
+	LazyQuotes bool
+	// Ragged is one of RaggedReject (the default), RaggedPad, RaggedSkip or RaggedError
+	Ragged string
+	// SkipRows is the number of lines to ignore before the header (or first row)
+	SkipRows int
+	// Header, if set, is called with the column names once they are known
+	Header func(columns []string)
+}
+
+func CsvGenerator(ctx context.Context, cancel context.CancelCauseFunc, in io.Reader) iter.Seq2[int, RenderArgs] {
+	return NewCsvGenerator(CsvOptions{}, nil)(ctx, cancel, in)
+}
+
+// NewCsvGenerator yields a record for each row, using either the first row or the
+// given columns as the header. Rows which cannot be parsed are passed to the rejector.
+func NewCsvGenerator(options CsvOptions, rejects *Rejector) Generator {
+	return func(ctx context.Context, cancel context.CancelCauseFunc, in io.Reader) iter.Seq2[int, RenderArgs] {
+		return func(yield func(int, RenderArgs) bool) {
+			buffered := bufio.NewReader(in)
+			for range options.SkipRows {
+				// preambles are not necessarily valid CSV, so are skipped without being parsed
+				if _, err := buffered.ReadString('\n'); err != nil {
+					if err != io.EOF {
+						cancel(fmt.Errorf("could not skip the first %v rows of the CSV file: %w", options.SkipRows, err))
+					}
+					return
+				}
+			}
+			// keep the input consumed by the CSV reader, so that rejected rows
+			// can be written exactly as they appeared
+			var consumed bytes.Buffer
+			r := csv.NewReader(io.TeeReader(buffered, &consumed))
+			if options.Comma != 0 {
+				r.Comma = options.Comma
 			}
-			if err != nil {
-				// just log the problem and continue
-				logger.Warn("could not parse a line", slog.Any("error", err))
-				continue
+			r.Comment = options.Comment
+			var offset int64
+			// rawRow returns the text of the row which was just read, without
+			// any comments or blank lines which preceded it
+			rawRow := func() string {
+				end := r.InputOffset()
+				text := string(consumed.Next(int(end - offset)))
+				offset = end
+				for {
+					line, rest, found := strings.Cut(text, "\n")
+					line = strings.TrimSuffix(line, "\r")
+					if !found || (line != "" && (r.Comment == 0 || !strings.HasPrefix(line, string(r.Comment)))) {
+						break
+					}
+					text = rest
+				}
+				return strings.TrimSuffix(strings.TrimSuffix(text, "\n"), "\r")
 			}
-			if len(record) != len(header) {
-				logger.Warn("Unexpected number of columns",
-					slog.Int("line number", lineNumber),
-					slog.Int("header size", len(header)),
-					slog.Int("record size", len(record)))
+			r.LazyQuotes = options.LazyQuotes
+			// the number of columns is checked below, so the row can be rejected
+			r.FieldsPerRecord = -1
+			header := options.Columns
+			if header == nil {
+				var err error
+				if header, err = r.Read(); err != nil {
+					cancel(fmt.Errorf("could not parse the header line of what should be a CSV file: %w", err))
+					return
+				}
+				rawRow()
 			}
-			result := make(map[string]string)
-			for i, h := range header {
-				result[strings.TrimSpace(h)] = strings.TrimSpace(record[i])
+			rejects.SetCSV(header, r.Comma, options.Columns == nil)
+			if options.Header != nil {
+				columns := make([]string, len(header))
+				for i, h := range header {
+					columns[i] = strings.TrimSpace(h)
+				}
+				options.Header(columns)
 			}
-			if !yield(result) {
-				return
+			for {
+				record, err := r.Read()
+				if err == io.EOF {
+					return
+				}
+				raw := rawRow()
+				if err != nil {
+					var parseError *csv.ParseError
+					if !errors.As(err, &parseError) {
+						// other errors, such as failing to read the input, will recur
+						cancel(fmt.Errorf("could not read the CSV file: %w", err))
+						return
+					}
+					rejects.Reject(parseError.StartLine+options.SkipRows, raw, err)
+					continue
+				}
+				lineNumber, _ := r.FieldPos(0)
+				lineNumber += options.SkipRows
+				if len(record) != len(header) {
+					mismatch := fmt.Errorf("unexpected number of columns on line %v: expected %v but found %v", lineNumber, len(header), len(record))
+					switch {
+					case options.Ragged == RaggedPad && len(record) < len(header):
+						record = append(record, make([]string, len(header)-len(record))...)
+					case options.Ragged == RaggedSkip:
+						logger.Debug("skipping CSV row", "error", mismatch)
+						continue
+					case options.Ragged == RaggedError:
+						cancel(mismatch)
+						return
+					default:
+						rejects.Reject(lineNumber, raw, mismatch)
+						continue
+					}
+				}
+				result := make(RenderArgs, len(header))
+				for i, h := range header {
+					result[strings.TrimSpace(h)] = strings.TrimSpace(record[i])
+				}
+				if !yield(lineNumber, result) {
+					return
+				}
 			}
 		}
 	}
@@ -0,0 +1,18 @@
+package dispatch
+
+import "testing"
+
+func TestCsvOptionsRejectsInvalidCharacters(t *testing.T) {
+	for _, c := range []struct{ delimiter, comment string }{{`\"`, ""}, {`\n`, ""}, {";", ";"}, {"", `\r`}, {"", ","}} {
+		var opts Opts
+		if c.delimiter != "" {
+			opts.CSVDelimiter = &c.delimiter
+		}
+		if c.comment != "" {
+			opts.CSVComment = &c.comment
+		}
+		if _, err := opts.CsvOptions(); err == nil {
+			t.Errorf("expected the delimiter %q and comment %q to be rejected", c.delimiter, c.comment)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package dispatch
+
+import (
+	"context"
+	"maps"
+
+	"github.com/nicois/bigset"
+)
+
+// markersInMemory is how many markers are remembered in memory
+// before switching to a disk-backed set
+const markersInMemory = 100_000
+
+// markerSet remembers which jobs have already been queued during this run,
+// so that identical jobs are only run once.
+type markerSet struct {
+	memory map[string]struct{}
+	disk   *bigset.Bigset[string]
+	// limit is how many markers are kept in memory
+	limit int
+}
+
+func newMarkerSet() *markerSet {
+	return &markerSet{memory: make(map[string]struct{}), limit: markersInMemory}
+}
+
+// Add remembers the marker, returning false if it was already present.
+func (m *markerSet) Add(ctx context.Context, marker string) (bool, error) {
+	if m.disk == nil {
+		if _, found := m.memory[marker]; found {
+			return false, nil
+		}
+		if len(m.memory) < m.limit {
+			m.memory[marker] = struct{}{}
+			return true, nil
+		}
+		// there are too many to keep in memory, so move them all to disk
+		disk, err := bigset.Create[string](logger)
+		if err != nil {
+			return false, err
+		}
+		if _, err := disk.AddSeq(ctx, "markers", maps.Keys(m.memory)); err != nil {
+			_ = disk.Close()
+			return false, err
+		}
+		logger.Debug("using a disk-backed set to detect duplicate jobs")
+		m.disk = disk
+		m.memory = nil
+	}
+	added, err := m.disk.Add(ctx, "markers", marker)
+	return added > 0, err
+}
+
+func (m *markerSet) Close() error {
+	if m.disk == nil {
+		return nil
+	}
+	return m.disk.Close()
+}
@@ -0,0 +1,47 @@
+package dispatch
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"testing"
+)
+
+func TestMarkerSet(t *testing.T) {
+	SetLogger(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	ctx := context.Background()
+	m := newMarkerSet()
+	m.limit = 100
+	defer func() {
+		if err := m.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+	add := func(marker string, expected bool) {
+		t.Helper()
+		added, err := m.Add(ctx, marker)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if added != expected {
+			t.Fatalf("expected adding %q to return %v", marker, expected)
+		}
+	}
+	add("a", true)
+	add("a", false)
+	add("b", true)
+
+	// fill the set until it moves to disk, which must remember what was in memory
+	for i := len(m.memory); i <= m.limit; i++ {
+		add(fmt.Sprint(i), true)
+	}
+	if m.disk == nil {
+		t.Fatal("expected the markers to have moved to disk")
+	}
+	add("a", false)
+	add(fmt.Sprint(m.limit), false)
+	add("50", false)
+	add("c", true)
+	add("c", false)
+}
@@ -0,0 +1,99 @@
+package dispatch
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+)
+
+// EnvTemplate is an environment variable whose value is rendered for each record
+type EnvTemplate struct {
+	Name  string
+	Value *template.Template
+}
+
+// ParseEnv interprets an environment variable definition of the form KEY=template
+func ParseEnv(spec string, missingKey string) (EnvTemplate, error) {
+	name, text, found := strings.Cut(spec, "=")
+	name = strings.TrimSpace(name)
+	if !found || name == "" {
+		return EnvTemplate{}, fmt.Errorf("environment variable %q should look like KEY=template", spec)
+	}
+	if strings.ToUpper(sanitiseEnvName(name)) != strings.ToUpper(name) {
+		return EnvTemplate{}, fmt.Errorf("%q is not a valid environment variable name", name)
+	}
+	t, err := NewTemplate(name, text, missingKey)
+	if err != nil {
+		return EnvTemplate{}, fmt.Errorf("cannot parse the template for environment variable %v: %w", name, err)
+	}
+	return EnvTemplate{Name: name, Value: t}, nil
+}
+
+// ParseEnvFile reads environment variable definitions from a file, one
+// KEY=template per line. Blank lines and lines starting with # are ignored.
+func ParseEnvFile(path string, missingKey string) ([]EnvTemplate, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read the environment file: %w", err)
+	}
+	var result []EnvTemplate
+	for line := range strings.Lines(string(content)) {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		env, err := ParseEnv(strings.TrimPrefix(line, "export "), missingKey)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %w", path, err)
+		}
+		result = append(result, env)
+	}
+	return result, nil
+}
+
+// recordEnv returns an environment variable for each field of the record, named
+// with the prefix followed by the sanitised field name. Lists and objects are
+// encoded as JSON. The fields added by dispatch itself are not included.
+func recordEnv(prefix string, args RenderArgs) map[string]string {
+	result := make(map[string]string, len(args))
+	for key, value := range args {
+		if strings.HasPrefix(key, "__") {
+			continue
+		}
+		var text string
+		switch value.(type) {
+		case []any, map[string]any:
+			encoded, err := json.Marshal(value)
+			if err != nil {
+				text = toString(value)
+			} else {
+				text = string(encoded)
+			}
+		default:
+			text = toString(value)
+		}
+		result[sanitiseEnvName(prefix+key)] = text
+	}
+	return result
+}
+
+// sanitiseEnvName converts a field name into a conventional environment variable
+// name, in upper case, with any other characters replaced by underscores
+func sanitiseEnvName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_':
+			return r
+		default:
+			return '_'
+		}
+	}, name)
+	if name != "" && name[0] >= '0' && name[0] <= '9' {
+		name = "_" + name
+	}
+	return name
+}
@@ -0,0 +1,179 @@
+package dispatch
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"iter"
+	"log/slog"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// NewFilesGenerator walks the filesystem, yielding a record for each file which
+// matches any of the include globs, and none of the exclude globs. In addition to
+// the usual wildcards, a "**" path segment matches any number of directories.
+// Exclude globs without a slash are compared to each file or directory name, rather
+// than the whole path. Unless hidden is set, names starting with a dot are skipped.
+//
+// Each record has the fields path, dir, base, stem, ext, size and mtime.
+// Files are yielded while the walk is in progress.
+func NewFilesGenerator(includes []string, excludes []string, hidden bool) (Generator, error) {
+	for _, pattern := range append(append([]string{}, includes...), excludes...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid glob %q: %w", pattern, err)
+		}
+	}
+	excluded := func(p string) bool {
+		for _, pattern := range excludes {
+			if strings.Contains(pattern, "/") {
+				if matchGlob(pattern, p) {
+					return true
+				}
+			} else if ok, _ := path.Match(pattern, path.Base(p)); ok {
+				return true
+			}
+		}
+		return false
+	}
+	return func(ctx context.Context, cancel context.CancelCauseFunc, in io.Reader) iter.Seq2[int, RenderArgs] {
+		return func(yield func(int, RenderArgs) bool) {
+			// a file may match several patterns, but should only be yielded once
+			seen := make(map[string]struct{})
+			var position int
+			for _, pattern := range includes {
+				pattern = path.Clean(filepath.ToSlash(pattern))
+				root := globRoot(pattern)
+				err := filepath.WalkDir(filepath.FromSlash(root), func(p string, d fs.DirEntry, err error) error {
+					if ctx.Err() != nil {
+						return filepath.SkipAll
+					}
+					if err != nil {
+						logger.Warn("cannot read part of the filesystem", slog.String("path", p), slog.Any("error", err))
+						return nil
+					}
+					p = filepath.ToSlash(p)
+					if p != root && ((!hidden && strings.HasPrefix(d.Name(), ".")) || excluded(p)) {
+						if d.IsDir() {
+							return filepath.SkipDir
+						}
+						return nil
+					}
+					if d.IsDir() {
+						if !couldMatchBeneath(pattern, p) {
+							return filepath.SkipDir
+						}
+						return nil
+					}
+					if !matchGlob(pattern, p) {
+						return nil
+					}
+					if _, ok := seen[p]; ok {
+						return nil
+					}
+					seen[p] = struct{}{}
+					info, err := d.Info()
+					if err != nil {
+						logger.Warn("cannot read file details", slog.String("path", p), slog.Any("error", err))
+						return nil
+					}
+					base := path.Base(p)
+					ext := path.Ext(base)
+					position++
+					if !yield(position, RenderArgs{
+						"path":  filepath.FromSlash(p),
+						"dir":   filepath.FromSlash(path.Dir(p)),
+						"base":  base,
+						"stem":  strings.TrimSuffix(base, ext),
+						"ext":   ext,
+						"size":  info.Size(),
+						"mtime": info.ModTime(),
+					}) {
+						return filepath.SkipAll
+					}
+					return nil
+				})
+				if err != nil {
+					cancel(fmt.Errorf("cannot walk %v: %w", root, err))
+					return
+				}
+				if ctx.Err() != nil {
+					return
+				}
+			}
+		}
+	}, nil
+}
+
+// globRoot returns the directory to start walking from: the
+// leading part of the pattern which contains no wildcards
+func globRoot(pattern string) string {
+	segments := strings.Split(pattern, "/")
+	i := 0
+	for ; i < len(segments)-1; i++ {
+		if strings.ContainsAny(segments[i], `*?[\`) {
+			break
+		}
+	}
+	if i == len(segments)-1 && !strings.ContainsAny(segments[i], `*?[\`) {
+		// there are no wildcards at all
+		return pattern
+	}
+	if root := strings.Join(segments[:i], "/"); root != "" {
+		return root
+	}
+	if strings.HasPrefix(pattern, "/") {
+		return "/"
+	}
+	return "."
+}
+
+// matchGlob reports whether the slash-separated name matches the pattern,
+// where a "**" segment matches zero or more path segments
+func matchGlob(pattern string, name string) bool {
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchSegments(pattern []string, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+// couldMatchBeneath reports whether anything inside the directory could match the pattern,
+// so that directories which cannot contain matching files are not walked
+func couldMatchBeneath(pattern string, dir string) bool {
+	if dir == "." {
+		return true
+	}
+	patternSegments := strings.Split(pattern, "/")
+	for i, segment := range strings.Split(dir, "/") {
+		if i >= len(patternSegments)-1 {
+			return patternSegments[len(patternSegments)-1] == "**"
+		}
+		if patternSegments[i] == "**" {
+			return true
+		}
+		if ok, _ := path.Match(patternSegments[i], segment); !ok {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,108 @@
+package dispatch
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestMatchGlob(t *testing.T) {
+	for _, c := range []struct {
+		pattern string
+		name    string
+		match   bool
+	}{
+		{"data/**/*.parquet", "data/a.parquet", true},
+		{"data/**/*.parquet", "data/2024/01/a.parquet", true},
+		{"data/**/*.parquet", "other/a.parquet", false},
+		{"data/*.csv", "data/sub/a.csv", false},
+		{"**", "a/b/c", true},
+	} {
+		if matchGlob(c.pattern, c.name) != c.match {
+			t.Errorf("expected matchGlob(%q, %q) to be %v", c.pattern, c.name, c.match)
+		}
+	}
+}
+
+func TestGlobRoot(t *testing.T) {
+	for pattern, expected := range map[string]string{
+		"data/**/*.parquet": "data",
+		"data/2024/*.csv":   "data/2024",
+		"*.csv":             ".",
+		"/srv/*/logs":       "/srv",
+		"/*.csv":            "/",
+		"data/a.csv":        "data/a.csv",
+	} {
+		if root := globRoot(pattern); root != expected {
+			t.Errorf("expected globRoot(%q) to be %q, not %q", pattern, expected, root)
+		}
+	}
+}
+
+func TestCouldMatchBeneath(t *testing.T) {
+	for _, c := range []struct {
+		pattern string
+		dir     string
+		match   bool
+	}{
+		{"data/*/a.csv", "data", true},
+		{"data/*/a.csv", "data/2024", true},
+		{"data/*/a.csv", "data/2024/01", false},
+		{"data/*/a.csv", "other", false},
+		{"data/**/a.csv", "data/2024/01", true},
+		{"data/**", "data/2024", true},
+		{"data/*", "data/2024", false},
+	} {
+		if couldMatchBeneath(c.pattern, c.dir) != c.match {
+			t.Errorf("expected couldMatchBeneath(%q, %q) to be %v", c.pattern, c.dir, c.match)
+		}
+	}
+}
+
+func TestFilesGenerator(t *testing.T) {
+	dir := filepath.ToSlash(t.TempDir())
+	for _, name := range []string{"data/a.parquet", "data/2024/b.parquet", "data/2024/notes.txt", "data/.hidden/c.parquet", "data/skip/d.parquet", "other/e.parquet"} {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte("12345"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	generator, err := NewFilesGenerator([]string{dir + "/data/**/*.parquet", dir + "/data/2024/*"}, []string{"skip", "*.txt"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stems []string
+	for _, record := range generator(context.Background(), nil, nil) {
+		stems = append(stems, record["stem"].(string))
+		if record["stem"] == "b" {
+			if record["dir"] != filepath.Join(dir, "data", "2024") || record["base"] != "b.parquet" || record["ext"] != ".parquet" || record["size"] != int64(5) {
+				t.Errorf("unexpected fields %v", record)
+			}
+		}
+	}
+	// files matching several patterns are only yielded once
+	slices.Sort(stems)
+	if expected := []string{"a", "b"}; !slices.Equal(stems, expected) {
+		t.Errorf("expected the files %v, got %v", expected, stems)
+	}
+	if _, err := NewFilesGenerator([]string{"data/["}, nil, false); err == nil {
+		t.Error("expected an invalid glob to be refused")
+	}
+}
+
+func TestFilesCannotBeCombined(t *testing.T) {
+	for _, opts := range []PreparationOpts{
+		{Files: []string{"*"}, CSV: true},
+		{Files: []string{"*"}, JsonLine: true},
+		{Files: []string{"*"}, InputFiles: []string{"-"}},
+	} {
+		if _, err := selectGenerator(Opts{PreparationOpts: opts}, '\n', nil, nil, nil); err == nil {
+			t.Errorf("expected %+v to be refused", opts)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package dispatch
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// followInterval is how often a followed file is checked for new data
+const followInterval = 250 * time.Millisecond
+
+// followReader behaves like `tail -F`: instead of returning io.EOF when it reaches
+// the end of the file, it waits for more data to be written. If the file is truncated,
+// it is read again from the beginning. If the file is replaced (for example, by log
+// rotation), the new file is read from the beginning. It only returns io.EOF when
+// the context is cancelled.
+type followReader struct {
+	ctx    context.Context
+	path   string
+	offset int64
+	// mutex protects file from being replaced while a read is being interrupted
+	mutex sync.Mutex
+	file  *os.File
+	// stop prevents reads being interrupted once the reader is closed
+	stop func() bool
+}
+
+// NewFollowReader opens the file (which may also be a named pipe) for following.
+// A named pipe is opened without waiting for a writer, which it would otherwise do
+// regardless of the context. Until there is a writer, it has no data to read.
+func NewFollowReader(ctx context.Context, path string) (io.ReadCloser, error) {
+	f, err := os.OpenFile(path, os.O_RDONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, err
+	}
+	result := &followReader{ctx: ctx, path: path, file: f}
+	// a named pipe may wait indefinitely for its writer to send more data
+	result.stop = context.AfterFunc(ctx, func() {
+		result.mutex.Lock()
+		defer result.mutex.Unlock()
+		_ = result.file.SetReadDeadline(time.Now())
+	})
+	return result, nil
+}
+
+func (f *followReader) Read(p []byte) (int, error) {
+	for {
+		n, err := f.file.Read(p)
+		f.offset += int64(n)
+		if n > 0 {
+			return n, nil
+		}
+		if err != nil && err != io.EOF {
+			if f.ctx.Err() != nil {
+				// the read was interrupted
+				return 0, io.EOF
+			}
+			return 0, err
+		}
+		// we have reached the end of the file, at least for now
+		f.checkForReplacement()
+		if Sleep(f.ctx, followInterval) != nil {
+			return 0, io.EOF
+		}
+	}
+}
+
+// checkForReplacement handles truncation and rotation of the file
+func (f *followReader) checkForReplacement() {
+	current, err := f.file.Stat()
+	if err != nil {
+		return
+	}
+	if current.Mode().IsRegular() && current.Size() < f.offset {
+		logger.Info("followed file was truncated; reading from the beginning", slog.String("path", f.path))
+		if _, err := f.file.Seek(0, io.SeekStart); err == nil {
+			f.offset = 0
+		}
+		return
+	}
+	latest, err := os.Stat(f.path)
+	if err != nil || os.SameFile(current, latest) {
+		// during rotation the file may briefly not exist; keep waiting
+		return
+	}
+	replacement, err := os.Open(f.path)
+	if err != nil {
+		return
+	}
+	logger.Info("followed file was replaced; reading the new file", slog.String("path", f.path))
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	_ = f.file.Close()
+	f.file = replacement
+	f.offset = 0
+}
+
+func (f *followReader) Close() error {
+	f.stop()
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.file.Close()
+}
@@ -0,0 +1,70 @@
+//go:build !windows
+// +build !windows
+
+package dispatch
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestFollowPipeWithoutWriter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jobs.fifo")
+	if err := syscall.Mkfifo(path, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	opened := make(chan io.ReadCloser, 1)
+	go func() {
+		f, err := NewFollowReader(ctx, path)
+		if err != nil {
+			t.Error(err)
+		}
+		opened <- f
+	}()
+	var f io.ReadCloser
+	select {
+	case f = <-opened:
+	case <-time.After(5 * time.Second):
+		t.Fatal("opening a named pipe without a writer should not block")
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	// data is read once a writer appears
+	writer, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := writer.WriteString("a\n"); err != nil {
+		t.Fatal(err)
+	}
+	buffer := make([]byte, 10)
+	if n, err := f.Read(buffer); err != nil || string(buffer[:n]) != "a\n" {
+		t.Errorf("expected to read what was written, got %q (%v)", buffer[:n], err)
+	}
+
+	// a read waiting for the writer stops when the context is cancelled
+	read := make(chan error, 1)
+	go func() {
+		_, err := f.Read(buffer)
+		read <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-read:
+		if err != io.EOF {
+			t.Errorf("expected EOF after cancellation, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("the read did not stop when the context was cancelled")
+	}
+	_ = writer.Close()
+}
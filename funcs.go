@@ -0,0 +1,246 @@
+package dispatch
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// TemplateFuncs are made available to every template. Where a function
+// takes several arguments, the value being operated on is the last one,
+// so that it can be used in a pipeline:
+//
+//	{{ .path | base | trimSuffix ".csv" }}
+var TemplateFuncs = template.FuncMap{
+	// base returns the last element of a path
+	"base": stringFunc(filepath.Base),
+	// dir returns all but the last element of a path
+	"dir": stringFunc(filepath.Dir),
+	// ext returns the file extension of a path, including the dot
+	"ext": stringFunc(filepath.Ext),
+	// trimExt removes the file extension (if any) from a path
+	"trimExt": stringFunc(func(s string) string { return strings.TrimSuffix(s, filepath.Ext(s)) }),
+	"upper":   stringFunc(strings.ToUpper),
+	"lower":   stringFunc(strings.ToLower),
+	// replace substitutes all instances of old with new
+	"replace": func(old, new string, v any) string { return strings.ReplaceAll(toString(v), old, new) },
+	// trim removes leading and trailing whitespace
+	"trim":       stringFunc(strings.TrimSpace),
+	"trimPrefix": func(prefix string, v any) string { return strings.TrimPrefix(toString(v), prefix) },
+	"trimSuffix": func(suffix string, v any) string { return strings.TrimSuffix(toString(v), suffix) },
+	// regexFind returns the first match of the regular expression, or an empty string
+	"regexFind": func(expression string, v any) (string, error) {
+		r, err := compileRegex(expression)
+		if err != nil {
+			return "", err
+		}
+		return r.FindString(toString(v)), nil
+	},
+	// regexCapture returns the first capture group of the first match
+	// of the regular expression, or an empty string
+	"regexCapture": func(expression string, v any) (string, error) {
+		r, err := compileRegex(expression)
+		if err != nil {
+			return "", err
+		}
+		if match := r.FindStringSubmatch(toString(v)); len(match) > 1 {
+			return match[1], nil
+		}
+		return "", nil
+	},
+	// regexReplace substitutes all matches of the regular expression,
+	// expanding $1 etc in the replacement
+	"regexReplace": func(expression, replacement string, v any) (string, error) {
+		r, err := compileRegex(expression)
+		if err != nil {
+			return "", err
+		}
+		return r.ReplaceAllString(toString(v), replacement), nil
+	},
+	// default returns the fallback if the value is missing or empty
+	"default": func(fallback, v any) any {
+		if toString(v) == "" {
+			return fallback
+		}
+		return v
+	},
+	// shellQuote makes the value safe to include in a shell command. Spread lists
+	// become a separate word for each item
+	"shellQuote": shellQuoteWords,
+	// shellEscapeSingle makes the value safe to include between single quotes in a shell command
+	"shellEscapeSingle": stringFunc(func(s string) string {
+		return strings.ReplaceAll(s, "'", `'\''`)
+	}),
+	// shellEscapeDouble makes the value safe to include between double quotes in a shell command
+	"shellEscapeDouble": stringFunc(shellDoubleQuoteEscaper.Replace),
+	// sqlQuote makes the value safe to include as a string in an SQL statement
+	"sqlQuote": stringFunc(func(s string) string { return "'" + strings.ReplaceAll(s, "'", "''") + "'" }),
+	// sha256 returns the hex-encoded SHA256 hash of the value
+	"sha256": stringFunc(func(s string) string { return fmt.Sprintf("%x", sha256.Sum256([]byte(s))) }),
+	// env returns the value of the named environment variable
+	"env": os.Getenv,
+	// spread renders each item of a list as a separate command-line argument, for
+	// example {{ .values | spread }}. Elsewhere, such as in the --input template or
+	// alongside other text, the items are separated by spaces
+	"spread": spread,
+	// toString renders the value as text, with missing values becoming an empty string
+	"toString": toString,
+	// now returns the current time
+	"now": time.Now,
+	// date formats a time using a Go reference layout, such as "2006-01-02".
+	// The time can be a time.Time, a RFC3339 string or a unix timestamp
+	"date": formatDate,
+}
+
+// toString converts a record value into the text which would be
+// rendered for it. Missing values become an empty string.
+func toString(v any) string {
+	switch s := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return s
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// stringFunc allows a string function to be applied to any record value
+func stringFunc(f func(string) string) func(any) string {
+	return func(v any) string {
+		return f(toString(v))
+	}
+}
+
+// spreadList is the result of the spread function: the items of a list, which
+// become separate command-line arguments if nothing else is in the argument
+type spreadList []string
+
+// String renders the items separated by spaces, where they cannot be separate arguments
+func (s spreadList) String() string {
+	return strings.Join(s, " ")
+}
+
+func spread(v any) spreadList {
+	switch list := v.(type) {
+	case []any:
+		items := make(spreadList, 0, len(list))
+		for _, item := range list {
+			items = append(items, toString(item))
+		}
+		return items
+	case []string:
+		return list
+	case spreadList:
+		return list
+	default:
+		return spreadList{toString(v)}
+	}
+}
+
+// encodeSpread writes each item of the list preceded by its length, so that the
+// items can be recovered exactly, whatever they contain
+func encodeSpread(list spreadList) string {
+	var sb strings.Builder
+	for _, item := range list {
+		sb.WriteString(strconv.Itoa(len(item)))
+		sb.WriteByte(':')
+		sb.WriteString(item)
+	}
+	return sb.String()
+}
+
+// decodeSpread recovers the items written by encodeSpread
+func decodeSpread(encoded string) ([]string, error) {
+	items := []string{}
+	for encoded != "" {
+		length, rest, found := strings.Cut(encoded, ":")
+		n, err := strconv.Atoi(length)
+		if !found || err != nil || n < 0 || n > len(rest) {
+			return nil, fmt.Errorf("cannot decode the spread list %q", encoded)
+		}
+		items = append(items, rest[:n])
+		encoded = rest[n:]
+	}
+	return items, nil
+}
+
+var (
+	regexCache      = make(map[string]*regexp.Regexp)
+	regexCacheMutex sync.Mutex
+)
+
+// compileRegex avoids recompiling the same expression for every record
+func compileRegex(expression string) (*regexp.Regexp, error) {
+	regexCacheMutex.Lock()
+	defer regexCacheMutex.Unlock()
+	if r, ok := regexCache[expression]; ok {
+		return r, nil
+	}
+	r, err := regexp.Compile(expression)
+	if err != nil {
+		return nil, err
+	}
+	regexCache[expression] = r
+	return r, nil
+}
+
+var shellDoubleQuoteEscaper = strings.NewReplacer(`\`, `\\`, `$`, `\$`, "`", "\\`", `"`, `\"`)
+
+// ShellQuote returns the string in a form which a POSIX shell will
+// interpret as a single literal word.
+func ShellQuote(s string) string {
+	if s == "" {
+		return "''"
+	}
+	if strings.IndexFunc(s, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("@%+=:,./_-", r))
+	}) == -1 {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func shellQuoteWords(v any) string {
+	list, ok := v.(spreadList)
+	if !ok {
+		return ShellQuote(toString(v))
+	}
+	words := make([]string, len(list))
+	for i, word := range list {
+		words[i] = ShellQuote(word)
+	}
+	return strings.Join(words, " ")
+}
+
+func formatDate(layout string, value any) (string, error) {
+	var t time.Time
+	switch v := value.(type) {
+	case time.Time:
+		t = v
+	case string, json.Number:
+		s := toString(v)
+		if seconds, err := strconv.ParseInt(s, 10, 64); err == nil {
+			t = time.Unix(seconds, 0)
+		} else if parsed, err := time.Parse(time.RFC3339, s); err == nil {
+			t = parsed
+		} else {
+			return "", fmt.Errorf("cannot interpret %q as a time", s)
+		}
+	case int:
+		t = time.Unix(int64(v), 0)
+	case int64:
+		t = time.Unix(v, 0)
+	default:
+		return "", fmt.Errorf("cannot interpret %v as a time", value)
+	}
+	return t.Format(layout), nil
+}
@@ -9,6 +9,7 @@ require (
 	github.com/jessevdk/go-flags v1.6.1
 	github.com/klauspost/compress v1.18.2
 	github.com/lmittmann/tint v1.1.2
+	github.com/mattn/go-sqlite3 v1.14.32
 	github.com/nicois/bigset v0.0.0-20251220071913-937d42d5f24e
 	golang.org/x/time v0.14.0
 )
@@ -31,7 +32,6 @@ require (
 	github.com/aws/aws-sdk-go-v2/service/ssooidc v1.35.12 // indirect
 	github.com/aws/aws-sdk-go-v2/service/sts v1.41.5 // indirect
 	github.com/aws/smithy-go v1.24.0 // indirect
-	github.com/mattn/go-sqlite3 v1.14.32 // indirect
 	github.com/nicois/fastdb v0.0.0-20250919114344-7a2afc19a22e // indirect
 	golang.org/x/sys v0.21.0 // indirect
 )
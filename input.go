@@ -0,0 +1,196 @@
+package dispatch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	"log/slog"
+	"maps"
+	"os"
+	"slices"
+	"sync"
+)
+
+// openInput opens the named file, where "-" refers to stdin.
+// If follow is set, the file is read like `tail -F` until the context is cancelled.
+func openInput(ctx context.Context, path string, stdin io.Reader, follow bool) (io.ReadCloser, error) {
+	if path == "-" {
+		return io.NopCloser(stdin), nil
+	}
+	var f io.ReadCloser
+	var err error
+	if follow {
+		f, err = NewFollowReader(ctx, path)
+	} else {
+		f, err = os.Open(path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot open input file: %w", err)
+	}
+	return f, nil
+}
+
+// NewInputFilesGenerator applies the generator to each of the files in turn,
+// rather than to the reader it is given. A path of "-" refers to that reader instead.
+// If follow is set, the files never end, so they are all read at the same time.
+func NewInputFilesGenerator(generator Generator, paths []string, follow bool) Generator {
+	if follow {
+		return followedInputFilesGenerator(generator, paths)
+	}
+	return func(ctx context.Context, cancel context.CancelCauseFunc, in io.Reader) iter.Seq2[int, RenderArgs] {
+		return func(yield func(int, RenderArgs) bool) {
+			for _, path := range paths {
+				f, err := openInput(ctx, path, in, false)
+				if err != nil {
+					cancel(err)
+					return
+				}
+				for lineNumber, args := range generator(ctx, cancel, f) {
+					if !yield(lineNumber, args) {
+						_ = f.Close()
+						return
+					}
+				}
+				_ = f.Close()
+			}
+		}
+	}
+}
+
+func followedInputFilesGenerator(generator Generator, paths []string) Generator {
+	return func(ctx context.Context, cancel context.CancelCauseFunc, in io.Reader) iter.Seq2[int, RenderArgs] {
+		return func(yield func(int, RenderArgs) bool) {
+			ctx, stop := context.WithCancel(ctx)
+			defer stop()
+			type record struct {
+				lineNumber int
+				args       RenderArgs
+			}
+			records := make(chan record)
+			wg := &sync.WaitGroup{}
+			for _, path := range paths {
+				f, err := openInput(ctx, path, in, true)
+				if err != nil {
+					cancel(err)
+					return
+				}
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					defer func() {
+						_ = f.Close()
+					}()
+					for lineNumber, args := range generator(ctx, cancel, f) {
+						select {
+						case <-ctx.Done():
+							return
+						case records <- record{lineNumber: lineNumber, args: args}:
+						}
+					}
+				}()
+			}
+			go func() {
+				wg.Wait()
+				close(records)
+			}()
+			for r := range records {
+				if !yield(r.lineNumber, r.args) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// ErrUnlinked is the reason for rejecting a record which cannot be linked
+// with the other input files, as at least one of them has no record on that line
+var ErrUnlinked = errors.New("not every input file has a record on this line")
+
+// NewLinkedInputFilesGenerator applies the generator to all of the files at once,
+// combining the records found on the same line of each file into a single record.
+// If any of the files has no record on a line (such as when it is rejected), the
+// other files' records on that line are rejected too, so that later records are
+// still combined correctly. Fields from later files take precedence, but each
+// file's record is also available as input1, input2 etc.
+// Records are generated until any of the files runs out.
+// If follow is set, the files are read like `tail -F`.
+func NewLinkedInputFilesGenerator(generator Generator, paths []string, follow bool, rejects *Rejector) Generator {
+	return func(ctx context.Context, cancel context.CancelCauseFunc, in io.Reader) iter.Seq2[int, RenderArgs] {
+		return func(yield func(int, RenderArgs) bool) {
+			nexts := make([]func() (int, RenderArgs, bool), 0, len(paths))
+			for _, path := range paths {
+				f, err := openInput(ctx, path, in, follow)
+				if err != nil {
+					cancel(err)
+					return
+				}
+				defer func() {
+					_ = f.Close()
+				}()
+				next, stop := iter.Pull2(generator(ctx, cancel, f))
+				defer stop()
+				nexts = append(nexts, next)
+			}
+			lineNumbers := make([]int, len(nexts))
+			records := make([]RenderArgs, len(nexts))
+			// advance reads the next record of a file, returning false if there are none
+			advance := func(i int) bool {
+				var ok bool
+				if lineNumbers[i], records[i], ok = nexts[i](); ok {
+					return true
+				}
+				if i > 0 {
+					logger.Warn("an input file ran out of records before the others", slog.String("input file", paths[i]))
+				} else {
+					for j, other := range nexts[1:] {
+						if _, _, ok := other(); ok {
+							logger.Warn("an input file has more records than the first one", slog.String("input file", paths[j+1]))
+						}
+					}
+				}
+				return false
+			}
+			// fields found in more than one file are only reported once
+			reported := make(map[string]bool)
+			for {
+				for i := range nexts {
+					if !advance(i) {
+						return
+					}
+				}
+				for {
+					lineNumber := slices.Max(lineNumbers)
+					aligned := true
+					for i := range nexts {
+						if lineNumbers[i] < lineNumber {
+							aligned = false
+							rejects.RejectRecord(lineNumbers[i], records[i], fmt.Errorf("%v: %w", paths[i], ErrUnlinked))
+							if !advance(i) {
+								return
+							}
+						}
+					}
+					if aligned {
+						break
+					}
+				}
+				result := make(RenderArgs)
+				for i, args := range records {
+					for field := range args {
+						if _, found := result[field]; found && !reported[field] {
+							reported[field] = true
+							logger.Warn("a field is in more than one input file, so the value from the last of them is used", slog.String("field", field), slog.String("input file", paths[i]))
+						}
+					}
+					maps.Copy(result, args)
+					result[fmt.Sprintf("input%d", i+1)] = args
+				}
+				if !yield(lineNumbers[0], result) {
+					return
+				}
+			}
+		}
+	}
+}
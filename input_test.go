@@ -0,0 +1,64 @@
+package dispatch
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLinkedInputFiles(t *testing.T) {
+	SetLogger(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	dir := t.TempDir()
+	first := filepath.Join(dir, "first.jsonl")
+	second := filepath.Join(dir, "second.jsonl")
+	for path, content := range map[string]string{
+		first:  `{"id": "1", "name": "one"}` + "\n" + `{"id": "2"}` + "\n" + `{"id": "3"}` + "\n",
+		second: `{"name": "x"}` + "\nnot json\n" + `{"name": "z"}` + "\n",
+	} {
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rejectPath := filepath.Join(dir, "rejects")
+	rejects, err := NewRejector(rejectPath, '\n', JSONFormat, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	generator := NewLinkedInputFilesGenerator(NewJsonLineGenerator('\n', rejects), []string{first, "-", second}, false, rejects)
+	var linked []string
+	for lineNumber, record := range generator(context.Background(), nil, strings.NewReader(`{"extra": "p"}`+"\n"+`{"extra": "q"}`+"\n"+`{"extra": "r"}`+"\n")) {
+		linked = append(linked, toString(lineNumber)+":"+toString(record["id"])+toString(record["name"])+toString(record["extra"]))
+		if lineNumber == 1 && record["input1"].(RenderArgs)["name"] != "one" {
+			t.Errorf("expected each file's record to be kept separately, got %v", record)
+		}
+	}
+	if err := rejects.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// the second line of the second file is rejected, so the second line of the others must not be used
+	if expected := "1:1xp 3:3zr"; strings.Join(linked, " ") != expected {
+		t.Errorf("expected %q, got %q", expected, strings.Join(linked, " "))
+	}
+	content, err := os.ReadFile(rejectPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "not json\n{\"id\":\"2\"}\n{\"extra\":\"q\"}\n"; string(content) != expected {
+		t.Errorf("expected the records on the second line to be rejected, got %q", content)
+	}
+}
+
+func TestStdinOnlyOnce(t *testing.T) {
+	opts := Opts{PreparationOpts: PreparationOpts{InputFiles: []string{"-", "other", "-"}}}
+	if _, err := selectGenerator(opts, '\n', nil, nil, nil); err == nil {
+		t.Error("expected STDIN to be refused as a second input file")
+	}
+	opts.InputFiles = opts.InputFiles[:2]
+	if _, err := selectGenerator(opts, '\n', nil, nil, nil); err != nil {
+		t.Errorf("expected STDIN to be accepted once, got %v", err)
+	}
+}
@@ -5,22 +5,32 @@ import (
 	"encoding/json"
 	"io"
 	"iter"
+	"strings"
 )
 
-func JsonLineGenerator(ctx context.Context, cancel context.CancelCauseFunc, in io.Reader) iter.Seq[RenderArgs] {
-	return func(yield func(RenderArgs) bool) {
-		for text := range LineReader(in, cancel) {
-			result := make(map[string]string)
-			err := json.Unmarshal([]byte(text), &result)
-			if err != nil {
-				// maybe we should just log the problem and continue?
-				if cancel != nil {
-					cancel(err)
+func JsonLineGenerator(ctx context.Context, cancel context.CancelCauseFunc, in io.Reader) iter.Seq2[int, RenderArgs] {
+	return NewJsonLineGenerator('\n', nil)(ctx, cancel, in)
+}
+
+// NewJsonLineGenerator decodes each line as a JSON object, where lines are
+// terminated by the delimiter. Lines which are not valid JSON objects are
+// passed to the rejector.
+func NewJsonLineGenerator(delimiter byte, rejects *Rejector) Generator {
+	return func(ctx context.Context, cancel context.CancelCauseFunc, in io.Reader) iter.Seq2[int, RenderArgs] {
+		return func(yield func(int, RenderArgs) bool) {
+			for lineNumber, text := range LineReader(in, delimiter, cancel) {
+				result := make(RenderArgs)
+				// preserve numbers exactly as written, rather than converting them to float64
+				decoder := json.NewDecoder(strings.NewReader(text))
+				decoder.UseNumber()
+				err := decoder.Decode(&result)
+				if err != nil {
+					rejects.Reject(lineNumber, text, err)
+					continue
+				}
+				if !yield(lineNumber, result) {
+					return
 				}
-				return
-			}
-			if !yield(result) {
-				return
 			}
 		}
 	}
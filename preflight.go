@@ -0,0 +1,125 @@
+package dispatch
+
+import (
+	"iter"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// preflightTimeout limits how long the preflight check waits for records to arrive,
+// so a slow source does not delay the first jobs. Whatever has arrived is inspected.
+const preflightTimeout = time.Second
+
+// sampleRecords reads up to n records before anything else happens, so they can be
+// inspected, waiting no longer than timeout for them. The returned sequence yields
+// every record, starting with the sample. If the sequence is not used, stop must be
+// called to release the records.
+func sampleRecords(records iter.Seq2[int, RenderArgs], n int, timeout time.Duration) (sample []RenderArgs, all iter.Seq2[int, RenderArgs], stop func()) {
+	next, stopPull := iter.Pull2(records)
+	type pulled struct {
+		lineNumber int
+		record     RenderArgs
+		ok         bool
+	}
+	// the sample is read in the background, in case the records are slow to arrive.
+	// Once it closes pulls, next is no longer in use.
+	pulls := make(chan pulled)
+	done := make(chan struct{})
+	go func() {
+		defer close(pulls)
+		for range n {
+			lineNumber, record, ok := next()
+			select {
+			case pulls <- pulled{lineNumber, record, ok}:
+			case <-done:
+				return
+			}
+			if !ok {
+				return
+			}
+		}
+	}()
+	stop = sync.OnceFunc(func() {
+		close(done)
+		// the sampler may be waiting for a record, which must arrive before the pull can stop
+		go func() {
+			for range pulls {
+			}
+			stopPull()
+		}()
+	})
+
+	var lineNumbers []int
+	exhausted := false
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+sampling:
+	for {
+		select {
+		case p, open := <-pulls:
+			if !open {
+				break sampling
+			}
+			if !p.ok {
+				exhausted = true
+				break sampling
+			}
+			lineNumbers = append(lineNumbers, p.lineNumber)
+			sample = append(sample, p.record)
+		case <-timer.C:
+			break sampling
+		}
+	}
+	return sample, func(yield func(int, RenderArgs) bool) {
+		defer stop()
+		for i, record := range sample {
+			if !yield(lineNumbers[i], record) {
+				return
+			}
+		}
+		if exhausted {
+			return
+		}
+		// records which the sampler reads after the timeout come next
+		for p := range pulls {
+			if !p.ok || !yield(p.lineNumber, p.record) {
+				return
+			}
+		}
+		for {
+			lineNumber, record, ok := next()
+			if !ok || !yield(lineNumber, record) {
+				return
+			}
+		}
+	}, stop
+}
+
+// checkFields compares the fields used by the templates with those found in the
+// sample of records, returning the fields which are used but never present, and
+// (if checkUnused is set) the fields which are present but never used. Fields
+// starting with an underscore are reserved, so are not checked.
+func checkFields(sample []RenderArgs, used FieldUsage, checkUnused bool) (missing []string, unused []string) {
+	present := make(map[string]bool)
+	for _, record := range sample {
+		for field := range record {
+			present[field] = true
+		}
+	}
+	for _, field := range slices.Sorted(maps.Keys(used.Fields)) {
+		if !strings.HasPrefix(field, "_") && !present[field] {
+			missing = append(missing, field)
+		}
+	}
+	if checkUnused && !used.WholeRecord {
+		for _, field := range slices.Sorted(maps.Keys(present)) {
+			if !strings.HasPrefix(field, "_") && !used.Fields[field] {
+				unused = append(unused, field)
+			}
+		}
+	}
+	return missing, unused
+}
@@ -0,0 +1,106 @@
+package dispatch
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckFields(t *testing.T) {
+	sample := []RenderArgs{{"a": 1, "b": 2, "__index": "x"}, {"a": 3, "_priority": 1}}
+	used := FieldUsage{Fields: map[string]bool{"a": true, "c": true, "__index": true}}
+	missing, unused := checkFields(sample, used, true)
+	if !slices.Equal(missing, []string{"c"}) {
+		t.Errorf("expected c to be missing, got %v", missing)
+	}
+	if !slices.Equal(unused, []string{"b"}) {
+		t.Errorf("expected b to be unused, got %v", unused)
+	}
+	used.WholeRecord = true
+	if _, unused := checkFields(sample, used, true); unused != nil {
+		t.Errorf("expected no unused fields when the whole record is used, got %v", unused)
+	}
+}
+
+func TestSampleRecords(t *testing.T) {
+	records := func(yield func(int, RenderArgs) bool) {
+		for i := 1; i <= 5; i++ {
+			if !yield(i, RenderArgs{"i": i}) {
+				return
+			}
+		}
+	}
+	sample, all, _ := sampleRecords(records, 3, time.Minute)
+	if len(sample) != 3 {
+		t.Errorf("expected a sample of 3 records, got %v", sample)
+	}
+	var lineNumbers []int
+	for lineNumber, record := range all {
+		if record["i"] != lineNumber {
+			t.Errorf("expected record %v at line %v", record, lineNumber)
+		}
+		lineNumbers = append(lineNumbers, lineNumber)
+	}
+	if expected := []int{1, 2, 3, 4, 5}; !slices.Equal(lineNumbers, expected) {
+		t.Errorf("expected the lines %v, got %v", expected, lineNumbers)
+	}
+	// fewer records than the sample size
+	if sample, _, stop := sampleRecords(records, 10, time.Minute); len(sample) != 5 {
+		t.Errorf("expected every record to be sampled, got %v", sample)
+	} else {
+		stop()
+	}
+}
+
+func TestSampleRecordsFromSlowSource(t *testing.T) {
+	release := make(chan struct{})
+	records := func(yield func(int, RenderArgs) bool) {
+		if !yield(1, RenderArgs{"i": 1}) {
+			return
+		}
+		// the rest of the records are slow to arrive
+		<-release
+		for i := 2; i <= 3; i++ {
+			if !yield(i, RenderArgs{"i": i}) {
+				return
+			}
+		}
+	}
+	started := time.Now()
+	sample, all, _ := sampleRecords(records, 10, 50*time.Millisecond)
+	if elapsed := time.Since(started); elapsed > 10*time.Second {
+		t.Errorf("expected sampling to stop waiting, but it took %v", elapsed)
+	}
+	if len(sample) != 1 {
+		t.Errorf("expected only the record which had arrived to be sampled, got %v", sample)
+	}
+	close(release)
+	var lineNumbers []int
+	for lineNumber := range all {
+		lineNumbers = append(lineNumbers, lineNumber)
+	}
+	if expected := []int{1, 2, 3}; !slices.Equal(lineNumbers, expected) {
+		t.Errorf("expected the lines %v, got %v", expected, lineNumbers)
+	}
+
+	// stopping does not wait for a record to arrive
+	blocked := make(chan struct{})
+	defer close(blocked)
+	_, _, stop := sampleRecords(func(yield func(int, RenderArgs) bool) { <-blocked }, 10, 10*time.Millisecond)
+	stop()
+}
+
+func TestCsvGeneratorReportsHeader(t *testing.T) {
+	var header []string
+	generator := NewCsvGenerator(CsvOptions{Header: func(columns []string) { header = columns }}, nil)
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+	for range generator(ctx, cancel, strings.NewReader("animal, name\n")) {
+		t.Error("expected no records")
+	}
+	if expected := []string{"animal", "name"}; !slices.Equal(header, expected) {
+		t.Errorf("expected the header %q, got %q", expected, header)
+	}
+}
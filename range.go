@@ -0,0 +1,116 @@
+package dispatch
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"iter"
+	"strconv"
+	"strings"
+)
+
+// Range is a sequence of integers from Start to End inclusive, in
+// increments of Step, which is negative when counting down.
+type Range struct {
+	Start int64
+	End   int64
+	Step  int64
+	// Width is the minimum number of digits, with shorter values being zero-padded
+	Width int
+}
+
+// ParseRange interprets a range definition of the form START..END[:STEP].
+// As with shell brace expansion, if START or END has a leading zero, values
+// are zero-padded to the longer of the two. When STEP is omitted, it is 1
+// or -1, depending on whether END is before START.
+func ParseRange(spec string) (Range, error) {
+	bounds, stepText, hasStep := strings.Cut(spec, ":")
+	startText, endText, found := strings.Cut(bounds, "..")
+	if !found {
+		return Range{}, fmt.Errorf("range %q should look like START..END or START..END:STEP", spec)
+	}
+	startText, endText = strings.TrimSpace(startText), strings.TrimSpace(endText)
+	start, err := strconv.ParseInt(startText, 10, 64)
+	if err != nil {
+		return Range{}, fmt.Errorf("range %q has an invalid start: %w", spec, err)
+	}
+	end, err := strconv.ParseInt(endText, 10, 64)
+	if err != nil {
+		return Range{}, fmt.Errorf("range %q has an invalid end: %w", spec, err)
+	}
+	result := Range{Start: start, End: end, Step: 1}
+	if end < start {
+		result.Step = -1
+	}
+	if hasStep {
+		step, err := strconv.ParseInt(strings.TrimSpace(stepText), 10, 64)
+		if err != nil || step == 0 {
+			return Range{}, fmt.Errorf("range %q should have a non-zero whole number as its step", spec)
+		}
+		if (step < 0) != (end < start) && start != end {
+			return Range{}, fmt.Errorf("range %q would never reach its end with a step of %v", spec, step)
+		}
+		result.Step = step
+	}
+	if zeroPadded(startText) || zeroPadded(endText) {
+		result.Width = max(len(strings.TrimPrefix(startText, "-")), len(strings.TrimPrefix(endText, "-")))
+	}
+	return result, nil
+}
+
+func zeroPadded(text string) bool {
+	text = strings.TrimPrefix(text, "-")
+	return len(text) > 1 && text[0] == '0'
+}
+
+// Values yields each value in the range, formatted as text
+func (r Range) Values() iter.Seq[string] {
+	return func(yield func(string) bool) {
+		for i := r.Start; ; i += r.Step {
+			if !yield(r.format(i)) {
+				return
+			}
+			// compare the distance remaining as unsigned values, so
+			// ranges reaching the limits of int64 do not overflow
+			remaining, step := uint64(r.End-i), uint64(r.Step)
+			if r.Step < 0 {
+				remaining, step = uint64(i-r.End), uint64(-r.Step)
+			}
+			if remaining < step {
+				return
+			}
+		}
+	}
+}
+
+func (r Range) format(i int64) string {
+	if i < 0 {
+		return fmt.Sprintf("-%0*d", r.Width, uint64(-i))
+	}
+	return fmt.Sprintf("%0*d", r.Width, i)
+}
+
+// NewRangeGenerator yields a record for each value of each range in turn, with
+// the value available as the value field. The input is ignored. If width is
+// greater than zero, it overrides the zero-padding of every range.
+func NewRangeGenerator(ranges []Range, width int) Generator {
+	return func(ctx context.Context, cancel context.CancelCauseFunc, in io.Reader) iter.Seq2[int, RenderArgs] {
+		return func(yield func(int, RenderArgs) bool) {
+			var position int
+			for _, r := range ranges {
+				if width > 0 {
+					r.Width = width
+				}
+				for value := range r.Values() {
+					if ctx.Err() != nil {
+						return
+					}
+					position++
+					if !yield(position, RenderArgs{"value": value}) {
+						return
+					}
+				}
+			}
+		}
+	}
+}
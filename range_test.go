@@ -0,0 +1,33 @@
+package dispatch
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestRangeValues(t *testing.T) {
+	for _, c := range []struct {
+		spec     string
+		expected []string
+	}{
+		{"1..3", []string{"1", "2", "3"}},
+		{"3..1", []string{"3", "2", "1"}},
+		{"0..10:4", []string{"0", "4", "8"}},
+		{"08..10", []string{"08", "09", "10"}},
+		{"-1..1", []string{"-1", "0", "1"}},
+		{"9223372036854775806..9223372036854775807", []string{"9223372036854775806", "9223372036854775807"}},
+	} {
+		r, err := ParseRange(c.spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if values := slices.Collect(r.Values()); !slices.Equal(values, c.expected) {
+			t.Errorf("expected %q to produce %v, not %v", c.spec, c.expected, values)
+		}
+	}
+	for _, spec := range []string{"1", "1..x", "1..3:0", "1..3:-1"} {
+		if _, err := ParseRange(spec); err == nil {
+			t.Errorf("expected %q to be invalid", spec)
+		}
+	}
+}
@@ -49,7 +49,7 @@ func (e *etc) Estimate(stats *Stats) (time.Duration, error) {
 	if len(e.failures)+len(e.successes) == 0 {
 		return time.Duration(0), errors.New("no sample data")
 	}
-	if stats.InProgress.Load()+stats.Queued.Load() == 0 {
+	if stats.InProgress.Load()+stats.Queued.Load()+stats.Retrying.Load() == 0 {
 		return time.Duration(0), nil
 	}
 	pSuccess := float64(len(e.successes)) / float64(len(e.successes)+len(e.failures))
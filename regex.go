@@ -0,0 +1,50 @@
+package dispatch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	"regexp"
+)
+
+var ErrNoMatch = errors.New("does not match the regular expression")
+
+// NewRegexGenerator applies the regular expression to each line, exposing its
+// named capture groups as fields (as well as the whole line, as "value").
+// Lines are terminated by the delimiter. Lines which do not match are passed to the rejector.
+func NewRegexGenerator(expression string, delimiter byte, rejects *Rejector) (Generator, error) {
+	r, err := regexp.Compile(expression)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse the regular expression: %w", err)
+	}
+	names := r.SubexpNames()
+	hasNames := false
+	for _, name := range names {
+		hasNames = hasNames || name != ""
+	}
+	if !hasNames {
+		return nil, fmt.Errorf("the regular expression %q has no named capture groups, such as (?P<name>...)", expression)
+	}
+	return func(ctx context.Context, cancel context.CancelCauseFunc, in io.Reader) iter.Seq2[int, RenderArgs] {
+		return func(yield func(int, RenderArgs) bool) {
+			for lineNumber, text := range LineReader(in, delimiter, cancel) {
+				match := r.FindStringSubmatch(text)
+				if match == nil {
+					rejects.Reject(lineNumber, text, ErrNoMatch)
+					continue
+				}
+				result := RenderArgs{"value": text}
+				for i, name := range names {
+					if name != "" {
+						result[name] = match[i]
+					}
+				}
+				if !yield(lineNumber, result) {
+					return
+				}
+			}
+		}
+	}, nil
+}
@@ -0,0 +1,55 @@
+package dispatch
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRegexGenerator(t *testing.T) {
+	SetLogger(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	path := filepath.Join(t.TempDir(), "rejects")
+	rejects, err := NewRejector(path, '\n', LineFormat, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	generator, err := NewRegexGenerator(`^(?P<user>\w+)@(?P<host>[\w.]+)$`, '\n', rejects)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records []RenderArgs
+	for _, record := range generator(context.Background(), nil, strings.NewReader("alice@example.com\nnot an address\nbob@localhost\n")) {
+		records = append(records, record)
+	}
+	if err := rejects.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("expected 2 records, got %v", records)
+	}
+	if records[0]["user"] != "alice" || records[0]["host"] != "example.com" || records[0]["value"] != "alice@example.com" {
+		t.Errorf("expected the capture groups and the whole line, got %v", records[0])
+	}
+	if records[1]["user"] != "bob" || records[1]["host"] != "localhost" {
+		t.Errorf("expected bob@localhost, got %v", records[1])
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "not an address\n"; string(content) != expected {
+		t.Errorf("expected the line which did not match to be rejected, got %q", content)
+	}
+}
+
+func TestRegexGeneratorNeedsNamedGroups(t *testing.T) {
+	for _, expression := range []string{`(\w+)@(\w+)`, `(`} {
+		if _, err := NewRegexGenerator(expression, '\n', nil); err == nil {
+			t.Errorf("expected %q to be refused", expression)
+		}
+	}
+}
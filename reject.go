@@ -0,0 +1,177 @@
+package dispatch
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"os"
+	"strings"
+	"sync"
+)
+
+// RecordFormat determines how a rejected record is written to the reject file,
+// which should match the format of the input
+type RecordFormat int
+
+const (
+	// LineFormat writes the record's value field
+	LineFormat RecordFormat = iota
+	// JSONFormat writes the record as a JSON object
+	JSONFormat
+	// CSVFormat writes the record as a CSV row, preceded by the header
+	CSVFormat
+)
+
+// Rejector keeps track of input which could not be turned into a job.
+// Rejected input is counted and logged, and optionally copied to a file
+// so that it can be corrected and resubmitted. As the rejected input is
+// kept in its original format, the line number and reason for each
+// rejection are written to a separate file alongside it.
+type Rejector struct {
+	mutex         sync.Mutex
+	writer        io.WriteCloser
+	reasons       io.WriteCloser
+	delimiter     byte
+	format        RecordFormat
+	header        []string
+	headerWritten bool
+	comma         rune
+	stats         *Stats
+}
+
+// NewRejector creates a Rejector. If path is empty, rejected input
+// is not written anywhere. Otherwise each rejected record is written
+// to the file in the given format, followed by the delimiter, and its
+// line number and reason are written to path + ".reasons".
+func NewRejector(path string, delimiter byte, format RecordFormat, stats *Stats) (*Rejector, error) {
+	result := &Rejector{stats: stats, delimiter: delimiter, format: format}
+	if path != "" {
+		f, err := os.Create(path)
+		if err != nil {
+			return nil, fmt.Errorf("cannot create the reject file: %w", err)
+		}
+		reasons, err := os.Create(path + ".reasons")
+		if err != nil {
+			_ = f.Close()
+			return nil, fmt.Errorf("cannot create the reject reasons file: %w", err)
+		}
+		result.writer = f
+		result.reasons = reasons
+	}
+	return result, nil
+}
+
+// SetCSV provides the CSV header and field delimiter. If the header was
+// part of the input, it is written to the reject file before the first
+// rejected record.
+func (r *Rejector) SetCSV(header []string, comma rune, headerInInput bool) {
+	if r == nil {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.header == nil {
+		r.header = header
+		r.comma = comma
+		r.headerWritten = !headerInInput
+	}
+}
+
+// Reject records that the raw input found at lineNumber could not be used.
+func (r *Rejector) Reject(lineNumber int, raw string, reason error) {
+	logger.Warn("rejected input", slog.Int("line number", lineNumber), slog.String("input", raw), slog.Any("reason", reason))
+	if r == nil {
+		return
+	}
+	if r.stats != nil {
+		r.stats.Rejected.Add(1)
+		r.stats.SetDirty()
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.writer == nil {
+		return
+	}
+	if r.format == CSVFormat && r.header != nil && !r.headerWritten {
+		r.write(encodeCSVRow(r.header, r.comma))
+		r.headerWritten = true
+	}
+	r.write(raw)
+	if _, err := fmt.Fprintf(r.reasons, "%v\t%v\n", lineNumber, strings.ReplaceAll(fmt.Sprint(reason), "\n", " ")); err != nil {
+		logger.Error("could not write to the reject reasons file", slog.Any("error", err))
+	}
+}
+
+// RejectRecord records that the record found at lineNumber could not be
+// used, writing it to the reject file in the same format as the input.
+func (r *Rejector) RejectRecord(lineNumber int, args RenderArgs, reason error) {
+	if r == nil {
+		r.Reject(lineNumber, encodeJSON(args), reason)
+		return
+	}
+	var raw string
+	switch r.format {
+	case CSVFormat:
+		fields := make([]string, 0, len(r.header))
+		for _, h := range r.header {
+			fields = append(fields, toString(args[strings.TrimSpace(h)]))
+		}
+		raw = encodeCSVRow(fields, r.comma)
+	case LineFormat:
+		if value, ok := args["value"]; ok {
+			raw = toString(value)
+			break
+		}
+		fallthrough
+	default:
+		raw = encodeJSON(args)
+	}
+	r.Reject(lineNumber, raw, reason)
+}
+
+func (r *Rejector) write(raw string) {
+	if _, err := fmt.Fprintf(r.writer, "%v%c", raw, r.delimiter); err != nil {
+		logger.Error("could not write to the reject file", slog.Any("error", err))
+	}
+}
+
+func (r *Rejector) Close() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.writer == nil {
+		return nil
+	}
+	err := errors.Join(r.writer.Close(), r.reasons.Close())
+	r.writer = nil
+	r.reasons = nil
+	return err
+}
+
+// encodeCSVRow returns the fields as a CSV row, without a trailing newline
+func encodeCSVRow(fields []string, comma rune) string {
+	var sb strings.Builder
+	w := csv.NewWriter(&sb)
+	if comma != 0 {
+		w.Comma = comma
+	}
+	_ = w.Write(fields)
+	w.Flush()
+	return strings.TrimSuffix(sb.String(), "\n")
+}
+
+// encodeJSON returns the record as a JSON object, excluding the fields added by dispatch
+func encodeJSON(args RenderArgs) string {
+	record := maps.Clone(args)
+	maps.DeleteFunc(record, func(k string, v any) bool {
+		return strings.HasPrefix(k, "__")
+	})
+	result, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Sprint(record)
+	}
+	return string(result)
+}
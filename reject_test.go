@@ -0,0 +1,77 @@
+package dispatch
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestRejectMalformedCSV(t *testing.T) {
+	SetLogger(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	path := filepath.Join(t.TempDir(), "rejects.csv")
+	rejects, err := NewRejector(path, '\n', CSVFormat, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := "a;b\n# a comment\n1;\"x\"y\n2;ok\n3;\"multi\nline\" z\n4;too;many\n5;fine\n"
+	generator := NewCsvGenerator(CsvOptions{Comma: ';', Comment: '#'}, rejects)
+	var values []string
+	for _, record := range generator(context.Background(), nil, strings.NewReader(input)) {
+		values = append(values, record["a"].(string))
+	}
+	if err := rejects.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"2", "5"}; !slices.Equal(values, expected) {
+		t.Errorf("expected the records %v, got %v", expected, values)
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "a;b\n1;\"x\"y\n3;\"multi\nline\" z\n4;too;many\n"; string(content) != expected {
+		t.Errorf("expected the reject file to contain %q, got %q", expected, content)
+	}
+}
+
+func TestRejectRecordLineNumber(t *testing.T) {
+	SetLogger(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	path := filepath.Join(t.TempDir(), "rejects.csv")
+	rejects, err := NewRejector(path, '\n', CSVFormat, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	generator := NewCsvGenerator(CsvOptions{Comment: '#'}, rejects)
+	var lineNumbers []int
+	for lineNumber, record := range generator(context.Background(), nil, strings.NewReader("a,__line\n# a comment\n1,x\n2,y\n")) {
+		lineNumbers = append(lineNumbers, lineNumber)
+		// the line number is not part of the record, so fields of any name are kept
+		if record["__line"] != "x" && record["__line"] != "y" {
+			t.Errorf("expected the __line field to be kept, got %v", record)
+		}
+		if record["a"] == "2" {
+			rejects.RejectRecord(lineNumber, record, errors.New("not wanted"))
+		}
+	}
+	if err := rejects.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if expected := []int{3, 4}; !slices.Equal(lineNumbers, expected) {
+		t.Errorf("expected the line numbers %v, got %v", expected, lineNumbers)
+	}
+	for filename, expected := range map[string]string{path: "a,__line\n2,y\n", path + ".reasons": "4\tnot wanted\n"} {
+		content, err := os.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) != expected {
+			t.Errorf("expected %v to contain %q, got %q", filename, expected, content)
+		}
+	}
+}
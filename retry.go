@@ -0,0 +1,161 @@
+package dispatch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// retryQueue returns failed jobs to the sorter once their backoff has elapsed,
+// so that other jobs can run in the meantime. It also counts the jobs which
+// have been queued but not finished, as the sorter's input must stay open
+// until none of them can be retried.
+type retryQueue struct {
+	commands  chan<- UnsortedCommand
+	pending   sync.WaitGroup
+	backoff   time.Duration
+	maxDelay  time.Duration
+	exitCodes []int
+	onTimeout bool
+
+	// waiting counts the jobs which are waiting to be requeued, which must
+	// finish before the sorter's input is closed
+	mu      sync.Mutex
+	closed  bool
+	waiting sync.WaitGroup
+}
+
+func newRetryQueue(commands chan<- UnsortedCommand, backoff time.Duration, maxDelay time.Duration, exitCodes []int, onTimeout bool) *retryQueue {
+	return &retryQueue{commands: commands, backoff: backoff, maxDelay: maxDelay, exitCodes: exitCodes, onTimeout: onTimeout}
+}
+
+// Add records a job which has been queued
+func (q *retryQueue) Add() {
+	if q == nil {
+		return
+	}
+	q.pending.Add(1)
+}
+
+// Done records a job which has finished, and will not be retried
+func (q *retryQueue) Done() {
+	if q == nil {
+		return
+	}
+	q.pending.Done()
+}
+
+// Wait blocks until every queued job has finished, unless the context is cancelled first
+func (q *retryQueue) Wait(ctx context.Context) {
+	if q == nil {
+		return
+	}
+	finished := make(chan struct{})
+	go func() {
+		q.pending.Wait()
+		close(finished)
+	}()
+	select {
+	case <-ctx.Done():
+	case <-finished:
+	}
+}
+
+// Close waits for the jobs which are waiting to be requeued, then closes the
+// sorter's input. Jobs which fail after this are not retried.
+func (q *retryQueue) Close() {
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+	q.waiting.Wait()
+	close(q.commands)
+}
+
+// Delay returns how long to wait before retrying a job which has failed this many
+// times. The delay doubles after each attempt, up to the maximum, and is reduced
+// by a random amount of up to half, so that jobs which failed together are not
+// all retried together.
+func (q *retryQueue) Delay(failures int) time.Duration {
+	delay := q.backoff
+	for i := 1; i < failures && delay < q.maxDelay; i++ {
+		delay *= 2
+	}
+	if q.maxDelay > 0 && delay > q.maxDelay {
+		delay = q.maxDelay
+	}
+	if delay <= 1 {
+		return delay
+	}
+	return delay - time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// Retry queues the job again once the delay has elapsed, then calls finished.
+// If the context is cancelled first, or the queue has been closed, the job is
+// not queued again, so it is done.
+func (q *retryQueue) Retry(ctx context.Context, command RenderedCommand, delay time.Duration, finished func(requeued bool)) {
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		// the callbacks are called without the lock, as they may take some time
+		finished(false)
+		q.Done()
+		return
+	}
+	q.waiting.Add(1)
+	q.mu.Unlock()
+	go func() {
+		defer q.waiting.Done()
+		if err := Sleep(ctx, delay); err != nil {
+			finished(false)
+			q.Done()
+			return
+		}
+		select {
+		case <-ctx.Done():
+			finished(false)
+			q.Done()
+		case q.commands <- UnsortedCommand{command: command, timestamp: command.timestamp, index: command.index}:
+			logger.Debug("requeued command", slog.Any("command", command))
+			finished(true)
+		}
+	}()
+}
+
+// RetryExitCodes returns the exit codes which cause a job to be retried.
+// If there are none, any failure is retried.
+func (o Opts) RetryExitCodes() ([]int, error) {
+	if o.RetryOnExit == nil {
+		return nil, nil
+	}
+	var result []int
+	for code := range strings.SplitSeq(*o.RetryOnExit, ",") {
+		value, err := strconv.Atoi(strings.TrimSpace(code))
+		if err != nil || value < 1 || value > 255 {
+			return nil, fmt.Errorf("%q is not an exit code which can be retried", code)
+		}
+		result = append(result, value)
+	}
+	return result, nil
+}
+
+// Retryable reports whether a job which failed with this error should be retried.
+// Timeouts are only retried when requested, and if exit codes are given, other
+// failures are only retried if the job exited with one of them.
+func (q *retryQueue) Retryable(err error, timedOut bool) bool {
+	if timedOut {
+		return q.onTimeout
+	}
+	if len(q.exitCodes) == 0 {
+		return true
+	}
+	var exitError *exec.ExitError
+	return errors.As(err, &exitError) && slices.Contains(q.exitCodes, exitError.ExitCode())
+}
@@ -0,0 +1,104 @@
+package dispatch
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+func TestRetryDelay(t *testing.T) {
+	q := newRetryQueue(nil, time.Second, 5*time.Second, nil, false)
+	for _, c := range []struct {
+		failures int
+		max      time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{4, 5 * time.Second},
+		{100, 5 * time.Second},
+	} {
+		if delay := q.Delay(c.failures); delay < c.max/2 || delay > c.max {
+			t.Errorf("expected the delay after %v failures to be between %v and %v, not %v", c.failures, c.max/2, c.max, delay)
+		}
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	exitError := exec.Command("sh", "-c", "exit 75").Run()
+	other := errors.New("could not start")
+	q := newRetryQueue(nil, time.Second, time.Minute, nil, false)
+	if !q.Retryable(other, false) {
+		t.Error("expected any failure to be retried by default")
+	}
+	if q.Retryable(exitError, true) {
+		t.Error("did not expect a timeout to be retried without --retry-on-timeout")
+	}
+	codes := "75, 111"
+	exitCodes, err := (Opts{ExecutionOpts: ExecutionOpts{RetryOnExit: &codes}}).RetryExitCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	q = newRetryQueue(nil, time.Second, time.Minute, exitCodes, false)
+	if !q.Retryable(exitError, false) {
+		t.Error("expected exit code 75 to be retried")
+	}
+	if q.Retryable(other, false) {
+		t.Error("did not expect a failure without an exit code to be retried")
+	}
+}
+
+func TestRetryCancelledWhilePending(t *testing.T) {
+	commands := make(chan UnsortedCommand)
+	q := newRetryQueue(commands, time.Hour, time.Hour, nil, false)
+	ctx, cancel := context.WithCancel(context.Background())
+	q.Add()
+	requeued := make(chan bool, 1)
+	q.Retry(ctx, RenderedCommand{}, time.Hour, func(r bool) { requeued <- r })
+	cancel()
+	q.Wait(ctx)
+	// the channel must not be closed until the pending retry has given up
+	q.Close()
+	if <-requeued {
+		t.Error("did not expect the job to be requeued after cancellation")
+	}
+	if _, ok := <-commands; ok {
+		t.Error("expected the channel to be closed")
+	}
+}
+
+func TestRetryAfterClose(t *testing.T) {
+	commands := make(chan UnsortedCommand)
+	q := newRetryQueue(commands, 0, time.Hour, nil, false)
+	q.Add()
+	q.Close()
+	var requeued *bool
+	q.Retry(context.Background(), RenderedCommand{}, 0, func(r bool) { requeued = &r })
+	if requeued == nil || *requeued {
+		t.Error("expected the job not to be requeued once the queue is closed")
+	}
+	q.Wait(context.Background())
+}
+
+func TestRetryCallbackIsNotLocked(t *testing.T) {
+	q := newRetryQueue(make(chan UnsortedCommand), 0, time.Hour, nil, false)
+	q.Add()
+	q.Add()
+	q.Close()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// the callback can use the queue, as the queue's lock is not held while it is called
+		q.Retry(context.Background(), RenderedCommand{}, 0, func(bool) {
+			q.Retry(context.Background(), RenderedCommand{}, 0, func(bool) {})
+		})
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("expected the callback to be able to use the queue")
+	}
+	q.Wait(context.Background())
+}
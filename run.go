@@ -3,13 +3,16 @@ package dispatch
 import (
 	"context"
 	"errors"
-	"html/template"
+	"fmt"
 	"io"
 	"log/slog"
 	"math/rand"
 	"os"
+	"slices"
+	"strings"
 	"sync"
 	"syscall"
+	"text/template"
 	"time"
 
 	"github.com/google/btree"
@@ -24,10 +27,13 @@ type UnsortedCommand struct {
 
 // Run will execute the jobs received via the `commands` channel,
 // respecting the provided context and the rate limiter.
+// Failed jobs are returned to the sorter via `retries`, if it is provided.
+// Jobs with a concurrency key must already hold it in `locks`, and it is
+// released once they have run.
 // Behaviour such as the level of concurrency is controlled via `opts`.
 // A pre-configured cache must also be provided, used to record output logs.
 // Statistics will also be updated continuously.
-func Run(ctx context.Context, stats *Stats, interruptChannel <-chan os.Signal, opts Opts, cache Cache, commands <-chan RenderedCommand, limiter *rate.Limiter) error {
+func Run(ctx context.Context, stats *Stats, interruptChannel <-chan os.Signal, opts Opts, cache Cache, commands <-chan RenderedCommand, limiter *rate.Limiter, locks *keyedMutex, retries *retryQueue) error {
 	ctx, cancel := context.WithCancelCause(ctx)
 	defer cancel(nil)
 
@@ -71,14 +77,16 @@ func Run(ctx context.Context, stats *Stats, interruptChannel <-chan os.Signal, o
 
 	signallers := make([]chan os.Signal, 0, opts.Concurrency)
 	// spawn the workers
+	runID := newRunID()
 	wg := &sync.WaitGroup{}
-	for range opts.Concurrency {
+	for i := range opts.Concurrency {
+		slot := i + 1
 		signaller := make(chan os.Signal, 2)
 		signallers = append(signallers, signaller)
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			Worker(ctx, opts, signaller, cancel, commands, cache, stats, limiter)
+			Worker(ctx, opts, signaller, cancel, commands, cache, stats, limiter, locks, retries, slot, runID)
 		}()
 	}
 
@@ -136,19 +144,87 @@ func Run(ctx context.Context, stats *Stats, interruptChannel <-chan os.Signal, o
 func PrepareAndRun(ctx context.Context, reader io.Reader, opts Opts, commandLine []string, cache Cache, interruptChannel <-chan os.Signal) error {
 	ctx, cancelCause := context.WithCancelCause(ctx)
 	defer cancelCause(nil)
-	var generator Generator
 
-	if opts.JsonLine {
-		generator = JsonLineGenerator
-	} else if opts.CSV {
-		generator = CsvGenerator
-	} else {
-		generator = SimpleLineGenerator
+	var limiter *rate.Limiter
+	var minimumDuration time.Duration
+	if opts.RateLimit != nil {
+		minimumDuration = *opts.RateLimit
+		if opts.RateLimitBucketSize < 1 {
+			opts.RateLimitBucketSize = 1
+		}
+		if *opts.RateLimit < time.Millisecond {
+			return errors.New("rate limit must be at least a millisecond if defined")
+		}
+		limiter = rate.NewLimiter(rate.Every(*opts.RateLimit), opts.RateLimitBucketSize)
+	}
+
+	// initialise the stats collector
+	stats := NewStats(opts.Concurrency, minimumDuration)
+	// when following, there is no end to estimate
+	stats.following = opts.Follow
+
+	delimiter, err := opts.LineDelimiter()
+	if err != nil {
+		return err
+	}
+	if opts.Retries < 0 {
+		return errors.New("the number of retries cannot be negative")
+	}
+	if opts.RetryBackoff < 0 {
+		return errors.New("the retry backoff cannot be negative")
+	}
+	if opts.RetryMaxDelay <= 0 {
+		return errors.New("the maximum retry delay must be positive")
+	}
+	retryExitCodes, err := opts.RetryExitCodes()
+	if err != nil {
+		return err
+	}
+	var rejectPath string
+	if opts.RejectFile != nil {
+		rejectPath = *opts.RejectFile
+	}
+	rejects, err := NewRejector(rejectPath, delimiter, rejectFormat(opts), stats)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = rejects.Close()
+	}()
+
+	var sqlite *SQLiteSource
+	if opts.SQLite != nil {
+		if opts.Query == nil {
+			return errors.New("--sqlite requires a --query to select the records")
+		}
+		if sqlite, err = OpenSQLite(*opts.SQLite, *opts.Query, opts.SQLiteAck != nil); err != nil {
+			return err
+		}
+		defer func() {
+			_ = sqlite.Close()
+		}()
+	} else if opts.Query != nil || opts.SQLiteAck != nil {
+		return errors.New("--query and --sqlite-ack can only be used with --sqlite")
+	}
+
+	// the CSV header describes the fields of every record, even if there are none
+	// it is read while the preflight check may still be waiting for records in the background
+	var csvHeader []string
+	var csvHeaderMutex sync.Mutex
+	generator, err := selectGenerator(opts, delimiter, rejects, sqlite, func(columns []string) {
+		csvHeaderMutex.Lock()
+		defer csvHeaderMutex.Unlock()
+		if csvHeader == nil {
+			csvHeader = columns
+		}
+	})
+	if err != nil {
+		return err
 	}
-	templ, err := ParseCommandline(commandLine)
+	templ, err := ParseCommandline(commandLine, opts.MissingKey)
 	var input *template.Template
 	if inputString := opts.Input; inputString != nil {
-		if t, err := template.New("Input").Parse(*inputString); err == nil {
+		if t, err := NewTemplate("Input", *inputString, opts.MissingKey); err == nil {
 			input = t
 		} else {
 			logger.Error("cannot parse the input template", slog.Any("error", err))
@@ -159,22 +235,106 @@ func PrepareAndRun(ctx context.Context, reader io.Reader, opts Opts, commandLine
 		logger.Error("Fatal error while parsing the commandline", slog.Any("error", err))
 		os.Exit(1)
 	}
-
-	var limiter *rate.Limiter
-	var minimumDuration time.Duration
-	if opts.RateLimit != nil {
-		minimumDuration = *opts.RateLimit
-		if opts.RateLimitBucketSize < 1 {
-			opts.RateLimitBucketSize = 1
+	jobTemplate := CommandTemplate{Command: templ, Input: input, EnvFromRecord: opts.EnvFromRecord}
+	if opts.Key != nil {
+		if jobTemplate.Key, err = NewTemplate("Key", *opts.Key, opts.MissingKey); err != nil {
+			return fmt.Errorf("cannot parse the key: %w", err)
 		}
-		if *opts.RateLimit < time.Millisecond {
-			return errors.New("rate limit must be at least a millisecond if defined")
+	}
+	if opts.WorkDir != nil {
+		if jobTemplate.WorkDir, err = NewTemplate("WorkDir", *opts.WorkDir, opts.MissingKey); err != nil {
+			return fmt.Errorf("cannot parse the working directory: %w", err)
 		}
-		limiter = rate.NewLimiter(rate.Every(*opts.RateLimit), opts.RateLimitBucketSize)
+	}
+	if opts.CommandFile != nil {
+		content, err := os.ReadFile(*opts.CommandFile)
+		if err != nil {
+			return fmt.Errorf("cannot read the command file: %w", err)
+		}
+		if jobTemplate.Script, err = NewTemplate("CommandFile", string(content), opts.MissingKey); err != nil {
+			return fmt.Errorf("cannot parse the command file: %w", err)
+		}
+	}
+	if opts.Shell != nil {
+		script := jobTemplate.Command
+		if jobTemplate.Script != nil {
+			script = []*template.Template{jobTemplate.Script}
+		}
+		if err := QuoteForShell(script); err != nil {
+			return err
+		}
+		jobTemplate.Shell = *opts.Shell
+	}
+	if opts.SQLiteAck != nil {
+		if jobTemplate.Ack, err = NewStatementTemplate("SQLiteAck", *opts.SQLiteAck, opts.MissingKey); err != nil {
+			return fmt.Errorf("cannot parse the SQLite acknowledgement: %w", err)
+		}
+		jobTemplate.Acknowledge = sqlite.Acknowledge
+	}
+	if opts.EnvFile != nil {
+		env, err := ParseEnvFile(*opts.EnvFile, opts.MissingKey)
+		if err != nil {
+			return err
+		}
+		jobTemplate.Env = append(jobTemplate.Env, env...)
+	}
+	for _, spec := range opts.Env {
+		env, err := ParseEnv(spec, opts.MissingKey)
+		if err != nil {
+			return err
+		}
+		jobTemplate.Env = append(jobTemplate.Env, env)
 	}
 
-	// initialise the stats collector
-	stats := NewStats(opts.Concurrency, minimumDuration)
+	used := UsedFields(jobTemplate.Templates()...)
+	if opts.EnvFromRecord != nil {
+		// every field is passed to the job in its environment
+		used.WholeRecord = true
+	}
+
+	records := generator(ctx, cancelCause, reader)
+	// batched records are nested, and followed input may not have any records yet
+	batching := opts.BatchSize > 1 || opts.BatchMaxBytes > 0
+	if opts.Preflight != "off" && !batching && !opts.Follow {
+		var sample []RenderArgs
+		var stop func()
+		sample, records, stop = sampleRecords(records, opts.PreflightRecords, preflightTimeout)
+		// reading the sample also reads the CSV header
+		described := fmt.Sprintf("the first %v records", len(sample))
+		csvHeaderMutex.Lock()
+		columns := csvHeader
+		csvHeaderMutex.Unlock()
+		if columns != nil {
+			header := make(RenderArgs, len(columns))
+			for _, column := range columns {
+				header[column] = ""
+			}
+			sample = append(sample, header)
+			described = "the CSV header"
+		}
+		if len(sample) > 0 {
+			// other fields are only expected in sources which describe whole records
+			missing, unused := checkFields(sample, used, opts.CSV || opts.JsonLine || opts.SQLite != nil)
+			if opts.MissingKey != "error" {
+				// missing fields are expected to be handled by the templates
+				missing = nil
+			}
+			var problems []string
+			if len(missing) > 0 {
+				problems = append(problems, fmt.Sprintf("the templates use fields which are not in %v: %v", described, strings.Join(missing, ", ")))
+			}
+			if len(unused) > 0 {
+				problems = append(problems, fmt.Sprintf("the templates do not use these fields: %v", strings.Join(unused, ", ")))
+			}
+			for _, problem := range problems {
+				logger.Warn("preflight check", slog.String("problem", problem))
+			}
+			if len(problems) > 0 && opts.Preflight == "error" {
+				stop()
+				return errors.New("the preflight check failed. Use --preflight=warn or --preflight=off to run regardless")
+			}
+		}
+	}
 
 	// this channel is where we insert jobs we want to do,
 	presortedCommands := make(chan UnsortedCommand, 10)
@@ -182,18 +342,54 @@ func PrepareAndRun(ctx context.Context, reader io.Reader, opts Opts, commandLine
 	// this channel provides the workers with the highest priority next job
 	postSortedCommands := make(chan RenderedCommand)
 
+	// failed jobs are inserted again, once their backoff has elapsed
+	retries := newRetryQueue(presortedCommands, time.Duration(opts.RetryBackoff), time.Duration(opts.RetryMaxDelay), retryExitCodes, opts.RetryOnTimeout)
+
 	// ingest STDIN, generating commands and updating stats
 	go func() {
-		defer close(presortedCommands)
+		// jobs waiting to be requeued must not send on the closed channel
+		defer retries.Close()
+		// jobs may be retried until they have all finished
+		defer retries.Wait(ctx)
+		var queued *markerSet
+		if opts.Deduplicate() {
+			queued = newMarkerSet()
+			defer func() {
+				_ = queued.Close()
+			}()
+		}
 		var index int64
-		for args := range generator(ctx, cancelCause, reader) {
+		// the position of each record in the input, unlike index which is used for sorting
+		var sequence int
+		for lineNumber, args := range records {
 			var mostRecentlyLastRun time.Time
-			renderedCommand, err := Render(templ, input, args)
+			controls, err := takeJobControls(args)
+			if err != nil {
+				rejects.RejectRecord(lineNumber, args, err)
+				continue
+			}
+			// only add the job's context if it is used, so that it is not
+			// included when the whole record is rendered
+			sequence++
+			if used.Fields[indexField] {
+				args[indexField] = sequence
+			}
+			for _, field := range runtimeFields {
+				if used.Fields[field] {
+					args[field] = runtimePlaceholder(field)
+				}
+			}
+			if opts.TmpDir && used.Fields[tmpdirField] {
+				args[tmpdirField] = runtimePlaceholder(tmpdirField)
+			}
+			renderedCommand, err := jobTemplate.Render(args)
 			if err != nil {
-				logger.Info("could not render", slog.Any("error", err))
-				stats.AddFailed(0)
+				logger.Warn("could not render", slog.Any("error", err))
+				stats.AddRenderFailed()
 				continue
 			}
+			renderedCommand.retries = opts.Retries
+			controls.apply(&renderedCommand)
 			marker := Marker(renderedCommand)
 			if mtime, err := cache.SuccessModTime(ctx, marker); err == nil {
 				if mtime.After(mostRecentlyLastRun) {
@@ -225,14 +421,28 @@ func PrepareAndRun(ctx context.Context, reader io.Reader, opts Opts, commandLine
 					}
 				}
 			}
+			if queued != nil {
+				// an identical job may already be waiting to run, or running
+				if isNew, err := queued.Add(ctx, marker); err != nil {
+					cancelCause(fmt.Errorf("could not check for duplicate jobs: %w", err))
+					return
+				} else if !isNew {
+					logger.Debug("skipping duplicate", slog.Any("command", renderedCommand))
+					stats.Duplicates.Add(1)
+					stats.SetDirty()
+					continue
+				}
+			}
 			if !opts.DeferReruns {
 				// treat all times as Zero, meaning that the original sequence is preserved in the btree, via the index
 				mostRecentlyLastRun = time.Time{}
 			}
 			if opts.Shuffle {
-			} else {
 				index = rand.Int63()
+			} else {
+				index++
 			}
+			retries.Add()
 			select {
 			case <-ctx.Done():
 				return
@@ -244,10 +454,12 @@ func PrepareAndRun(ctx context.Context, reader io.Reader, opts Opts, commandLine
 		}
 	}()
 
-	go sorter(ctx, opts, presortedCommands, postSortedCommands)
+	// jobs sharing a concurrency key must not run at the same time
+	locks := newKeyedMutex()
+	go sorter(ctx, opts, presortedCommands, postSortedCommands, locks)
 
 	// call the main entrypoint, now everything is in place
-	err = Run(ctx, stats, interruptChannel, opts, cache, postSortedCommands, limiter)
+	err = Run(ctx, stats, interruptChannel, opts, cache, postSortedCommands, limiter, locks, retries)
 	// provide a summary before exiting
 	logger.Info(stats.String())
 	if errors.Is(err, ErrNoMoreJobs) {
@@ -256,14 +468,149 @@ func PrepareAndRun(ctx context.Context, reader io.Reader, opts Opts, commandLine
 	return err
 }
 
+// selectGenerator chooses how records are generated, based on the options.
+// If the records are read from CSV, csvHeader is called with the header.
+func selectGenerator(opts Opts, delimiter byte, rejects *Rejector, sqlite *SQLiteSource, csvHeader func(columns []string)) (Generator, error) {
+	var generator Generator
+	if sqlite != nil {
+		generator = sqlite.Generator()
+	} else if opts.JsonLine {
+		generator = NewJsonLineGenerator(delimiter, rejects)
+	} else if opts.CSV {
+		options, err := opts.CsvOptions()
+		if err != nil {
+			return nil, err
+		}
+		options.Header = csvHeader
+		generator = NewCsvGenerator(options, rejects)
+	} else if opts.Regex != nil {
+		var err error
+		if generator, err = NewRegexGenerator(*opts.Regex, delimiter, rejects); err != nil {
+			return nil, err
+		}
+	} else if separator, split, err := opts.SplitFields(); err != nil {
+		return nil, err
+	} else if split {
+		var names []string
+		if opts.FieldNames != nil {
+			for name := range strings.SplitSeq(*opts.FieldNames, ",") {
+				names = append(names, strings.TrimSpace(name))
+			}
+		}
+		if generator, err = NewSplitLineGenerator(delimiter, !opts.NoTrim && !opts.Null, separator, names); err != nil {
+			return nil, err
+		}
+	} else {
+		// NUL-separated input usually consists of filenames, which should be used verbatim
+		generator = NewSimpleLineGenerator(delimiter, !opts.NoTrim && !opts.Null)
+	}
+	if len(opts.Files) > 0 && len(opts.Ranges) > 0 {
+		return nil, errors.New("--files and --range cannot be used together")
+	}
+	if len(opts.Files) > 0 && (len(opts.InputFiles) > 0 || opts.CSV || opts.JsonLine || opts.Regex != nil || opts.SQLite != nil) {
+		return nil, errors.New("--files cannot be used with --input-file, --csv, --json-line, --regex or --sqlite")
+	}
+	if opts.Follow && (len(opts.Files) > 0 || len(opts.Ranges) > 0) {
+		return nil, errors.New("--follow cannot be used with --files or --range")
+	}
+	if len(opts.Files) > 0 {
+		var err error
+		if generator, err = NewFilesGenerator(opts.Files, opts.Exclude, opts.Hidden); err != nil {
+			return nil, err
+		}
+	} else if len(opts.Ranges) > 0 {
+		ranges := make([]Range, 0, len(opts.Ranges))
+		for _, spec := range opts.Ranges {
+			r, err := ParseRange(spec)
+			if err != nil {
+				return nil, err
+			}
+			ranges = append(ranges, r)
+		}
+		generator = NewRangeGenerator(ranges, opts.RangeWidth)
+	} else if len(opts.InputFiles) > 0 {
+		var stdin int
+		for _, path := range opts.InputFiles {
+			if path == "-" {
+				stdin++
+			}
+		}
+		if stdin > 1 {
+			return nil, errors.New("STDIN (-) can only be given once as an --input-file")
+		}
+		if opts.Link {
+			generator = NewLinkedInputFilesGenerator(generator, opts.InputFiles, opts.Follow, rejects)
+		} else {
+			generator = NewInputFilesGenerator(generator, opts.InputFiles, opts.Follow)
+		}
+	} else if opts.Follow {
+		return nil, errors.New("--follow can only be used with --input-file")
+	}
+	if len(opts.Axes) > 0 {
+		axes := make([]Axis, 0, len(opts.Axes))
+		for _, spec := range opts.Axes {
+			axis, err := ParseAxis(spec)
+			if err != nil {
+				return nil, err
+			}
+			axes = append(axes, axis)
+		}
+		if opts.CrossInput {
+			generator = NewAxisGenerator(axes, generator)
+		} else {
+			generator = NewAxisGenerator(axes, nil)
+		}
+	}
+	var schema *Schema
+	if opts.Schema != nil {
+		var err error
+		if schema, err = LoadSchema(*opts.Schema); err != nil {
+			return nil, err
+		}
+	}
+	if opts.RequireFields != nil {
+		if schema == nil {
+			schema = &Schema{}
+		}
+		for field := range strings.SplitSeq(*opts.RequireFields, ",") {
+			schema.Required = append(schema.Required, strings.TrimSpace(field))
+		}
+	}
+	if schema != nil {
+		generator = NewValidatingGenerator(generator, schema, rejects)
+	}
+	if opts.BatchSize > 1 || opts.BatchMaxBytes > 0 {
+		generator = NewBatchGenerator(generator, opts.BatchSize, opts.BatchMaxBytes)
+	}
+	return generator, nil
+}
+
+// rejectFormat chooses how rejected records are written, to match the input
+func rejectFormat(opts Opts) RecordFormat {
+	switch {
+	case len(opts.Files) > 0 || opts.SQLite != nil || (len(opts.Axes) > 0 && !opts.CrossInput):
+		// there is no input to match, so use the most expressive format
+		return JSONFormat
+	case opts.JsonLine:
+		return JSONFormat
+	case opts.CSV:
+		return CSVFormat
+	default:
+		return LineFormat
+	}
+}
+
 func lessUnsortedCommand(a, b UnsortedCommand) bool {
+	if a.command.priority != b.command.priority {
+		return a.command.priority > b.command.priority
+	}
 	if a.timestamp.Equal(b.timestamp) {
 		return a.index < b.index
 	}
 	return a.timestamp.Before(b.timestamp)
 }
 
-func sorter(ctx context.Context, opts Opts, presortedCommands <-chan UnsortedCommand, postSortedCommands chan<- RenderedCommand) {
+func sorter(ctx context.Context, opts Opts, presortedCommands <-chan UnsortedCommand, postSortedCommands chan<- RenderedCommand, locks *keyedMutex) {
 	// hold a sorted representation of the commands
 	tree := btree.NewG(2, lessUnsortedCommand)
 
@@ -292,7 +639,7 @@ func sorter(ctx context.Context, opts Opts, presortedCommands <-chan UnsortedCom
 					// channel is closed; nothing more is incoming
 					return
 				}
-				if uc.timestamp.IsZero() {
+				if uc.timestamp.IsZero() && !opts.Shuffle {
 					// similate a very old time, but not identical to other very old times
 					minitime = minitime.Add(time.Nanosecond)
 					uc.timestamp = minitime
@@ -332,17 +679,35 @@ func sorter(ctx context.Context, opts Opts, presortedCommands <-chan UnsortedCom
 		_ = Sleep(ctx, delay)
 	}
 
+	// jobs whose concurrency key is in use wait here, in order, rather than
+	// occupying a worker, so that jobs with other keys can run meanwhile
+	waiting := make(map[string][]UnsortedCommand)
+	mail := youHaveMail
+	var finalIteration bool
 	for {
-		var finalIteration bool
-
 		// wait for at least one item to be in the btree
 		select {
 		case <-ctx.Done():
 			return
-		case _, ok := <-youHaveMail:
+		case _, ok := <-mail:
 			if !ok {
 				finalIteration = true
+				mail = nil
 			}
+		case <-locks.Released():
+			// the next job for each key which is no longer in use can be sent
+			mutex.Lock()
+			for key, queue := range waiting {
+				if !locks.Held(key) {
+					tree.ReplaceOrInsert(queue[0])
+					if len(queue) == 1 {
+						delete(waiting, key)
+					} else {
+						waiting[key] = queue[1:]
+					}
+				}
+			}
+			mutex.Unlock()
 		}
 		// keep sending the oldest known item until the tree
 		// is empty or the context is cancelled
@@ -351,17 +716,31 @@ func sorter(ctx context.Context, opts Opts, presortedCommands <-chan UnsortedCom
 			uc, found := tree.DeleteMin()
 			mutex.Unlock()
 			if !found {
-				if finalIteration {
+				if finalIteration && len(waiting) == 0 {
 					return
 				}
 				break
 			}
+			if key := uc.command.concurrencyKey; key != "" && !locks.TryLock(key) {
+				queue := waiting[key]
+				i, _ := slices.BinarySearchFunc(queue, uc, func(a, b UnsortedCommand) int {
+					if lessUnsortedCommand(a, b) {
+						return -1
+					}
+					return 1
+				})
+				waiting[key] = slices.Insert(queue, i, uc)
+				continue
+			}
 			select {
 			case <-ctx.Done():
 				return
 			default:
 			}
 
+			// remember the job's position, in case it is retried
+			uc.command.timestamp = uc.timestamp
+			uc.command.index = uc.index
 			select {
 			case <-ctx.Done():
 				return
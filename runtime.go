@@ -0,0 +1,93 @@
+package dispatch
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+)
+
+// Fields which describe the context a job runs in, rather than the record
+const (
+	// indexField is the position of the record in the input, starting from 1
+	indexField = "__index"
+	// slotField is the number of the worker running the job, from 1 to the concurrency
+	slotField = "__slot"
+	// attemptField counts the attempts to run the job, starting from 1
+	attemptField = "__attempt"
+	// markerField identifies the job in the cache
+	markerField = "__marker"
+	// runIDField is unique to each invocation of dispatch
+	runIDField = "__run_id"
+	// startTimeField is the time the job started, in RFC3339 format
+	startTimeField = "__start_time"
+	// tmpdirField exposes the job's temporary directory, when using --tmpdir
+	tmpdirField = "__tmpdir"
+	// scriptField is the path of the file the job's script is written to, when using --command-file
+	scriptField = "__script"
+)
+
+// Some values are only known once a job starts running, but the job's
+// marker is calculated when it is queued. These fields are rendered as
+// placeholders, which are replaced just before the job is run, so that
+// the marker does not depend on them.
+const placeholderDelimiter = "\x1d"
+
+// runtimeFields are only known once a job starts running
+var runtimeFields = []string{slotField, attemptField, markerField, runIDField, startTimeField}
+
+// runtimePlaceholder returns the text which stands in for a runtime field.
+// It contains control characters, so it cannot clash with real input and
+// is always quoted when using --shell.
+func runtimePlaceholder(name string) string {
+	return placeholderDelimiter + name + placeholderDelimiter
+}
+
+// withRuntime returns a copy of the command, with the placeholders for
+// the given runtime fields replaced by their values
+func (c RenderedCommand) withRuntime(values map[string]string) RenderedCommand {
+	if len(values) == 0 {
+		return c
+	}
+	pairs := make([]string, 0, 2*len(values))
+	for name, value := range values {
+		pairs = append(pairs, runtimePlaceholder(name), value)
+	}
+	replacer := strings.NewReplacer(pairs...)
+	result := c
+	result.command = make([]string, len(c.command))
+	for i, arg := range c.command {
+		result.command[i] = replacer.Replace(arg)
+	}
+	result.env = make([]string, len(c.env))
+	for i, env := range c.env {
+		result.env[i] = replacer.Replace(env)
+	}
+	result.input = replacer.Replace(c.input)
+	result.script = replacer.Replace(c.script)
+	result.workdir = replacer.Replace(c.workdir)
+	result.ack = replacer.Replace(c.ack)
+	result.ackParameters = make([]any, len(c.ackParameters))
+	for i, parameter := range c.ackParameters {
+		if s, ok := parameter.(string); ok {
+			parameter = replacer.Replace(s)
+		}
+		result.ackParameters[i] = parameter
+	}
+	return result
+}
+
+// describeRuntime makes any placeholders readable, so {{.__tmpdir}} is logged as <__tmpdir>
+func describeRuntime(s string) string {
+	parts := strings.Split(s, placeholderDelimiter)
+	for i := 1; i < len(parts)-1; i += 2 {
+		parts[i] = "<" + parts[i] + ">"
+	}
+	return strings.Join(parts, "")
+}
+
+// newRunID returns a random identifier for this invocation of dispatch
+func newRunID() string {
+	id := make([]byte, 8)
+	_, _ = rand.Read(id)
+	return hex.EncodeToString(id)
+}
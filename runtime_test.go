@@ -0,0 +1,58 @@
+package dispatch
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRuntimeFieldsDoNotChangeMarker(t *testing.T) {
+	text := "{{.value}} {{.__slot}} {{.__attempt}} {{.__marker}} {{.__run_id}} {{.__start_time}}"
+	jobTemplate := CommandTemplate{
+		Command: Must(ParseCommandline([]string{"run", text}, "error")),
+		Script:  Must(NewTemplate("Script", text, "error")),
+		Input:   Must(NewTemplate("Input", text, "error")),
+		WorkDir: Must(NewTemplate("WorkDir", text, "error")),
+		Env:     []EnvTemplate{Must(ParseEnv("CONTEXT="+text, "error"))},
+		Ack:     Must(NewStatementTemplate("Ack", text, "error")),
+	}
+	// render the job as it is queued, with placeholders for the runtime fields
+	render := func() RenderedCommand {
+		args := RenderArgs{"value": "v"}
+		for _, field := range runtimeFields {
+			args[field] = runtimePlaceholder(field)
+		}
+		rendered, err := jobTemplate.Render(args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rendered
+	}
+	queued := render()
+	marker := Marker(queued)
+	var jobs []RenderedCommand
+	for _, values := range []map[string]string{
+		{slotField: "1", attemptField: "1", markerField: marker, runIDField: "run1", startTimeField: "2026-01-01T00:00:00Z"},
+		{slotField: "2", attemptField: "3", markerField: marker, runIDField: "run2", startTimeField: "2026-01-02T00:00:00Z"},
+	} {
+		// the marker is calculated before the runtime fields are substituted
+		if m := Marker(render()); m != marker {
+			t.Errorf("expected the marker to be %v, not %v", marker, m)
+		}
+		job := queued.withRuntime(values)
+		expected := "v " + values[slotField] + " " + values[attemptField] + " " + marker + " " + values[runIDField] + " " + values[startTimeField]
+		for name, actual := range map[string]string{"command": job.command[len(job.command)-1], "script": job.script, "input": job.input, "workdir": job.workdir, "env": strings.TrimPrefix(job.env[0], "CONTEXT=")} {
+			if actual != expected {
+				t.Errorf("expected the %v to be %q, got %q", name, expected, actual)
+			}
+		}
+		// the acknowledgement's values are bound as parameters
+		if parameters := []any{"v", values[slotField], values[attemptField], marker, values[runIDField], values[startTimeField]}; job.ack != "? ? ? ? ? ?" || !reflect.DeepEqual(job.ackParameters, parameters) {
+			t.Errorf("expected the acknowledgement to bind %v, got %q with %v", parameters, job.ack, job.ackParameters)
+		}
+		jobs = append(jobs, job)
+	}
+	if reflect.DeepEqual(jobs[0].command, jobs[1].command) {
+		t.Error("expected the runtime fields to change the command which is run")
+	}
+}
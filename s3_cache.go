@@ -88,6 +88,10 @@ func (f *s3Cache) failurePath(marker string) string {
 	return strings.TrimPrefix(filepath.Join(f.prefix, "failure", marker), "/")
 }
 
+func (f *s3Cache) descriptionPath(marker string) string {
+	return strings.TrimPrefix(filepath.Join(f.prefix, "description", marker), "/")
+}
+
 func (f *s3Cache) WriteSuccess(ctx context.Context, marker string, data []byte) error {
 	return f.put(ctx, f.successPath(marker), data)
 }
@@ -96,6 +100,10 @@ func (f *s3Cache) WriteFailure(ctx context.Context, marker string, data []byte)
 	return f.put(ctx, f.failurePath(marker), data)
 }
 
+func (f *s3Cache) WriteDescription(ctx context.Context, marker string, data []byte) error {
+	return f.put(ctx, f.descriptionPath(marker), data)
+}
+
 func (f *s3Cache) put(ctx context.Context, path string, data []byte) error {
 	_, err := f.client.PutObject(ctx, &s3.PutObjectInput{Bucket: &(f.bucket), Key: &path, Body: bytes.NewReader(data)})
 	return err
@@ -133,6 +141,10 @@ func (f *s3Cache) ReadFailure(ctx context.Context, marker string) ([]byte, error
 	return f.read(ctx, f.failurePath(marker))
 }
 
+func (f *s3Cache) ReadDescription(ctx context.Context, marker string) ([]byte, error) {
+	return f.read(ctx, f.descriptionPath(marker))
+}
+
 func readCloserToBytes(rc io.ReadCloser) ([]byte, error) {
 	// Ensure the ReadCloser is closed to prevent resource leaks
 	defer func() {
@@ -0,0 +1,147 @@
+package dispatch
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"iter"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Schema describes what a valid record looks like, using a small subset of JSON Schema:
+//
+//	{"required": ["id"], "properties": {"id": {"type": "integer", "pattern": "^[0-9]+$"}}}
+//
+// As CSV and line-based input only contains strings, strings are accepted
+// as numbers, integers and booleans if they can be parsed as such.
+type Schema struct {
+	Required   []string                   `json:"required"`
+	Properties map[string]*SchemaProperty `json:"properties"`
+}
+
+type SchemaProperty struct {
+	// Type is one or more of string, number, integer, boolean, array, object or null
+	Type    schemaTypes `json:"type"`
+	Pattern string      `json:"pattern"`
+	pattern *regexp.Regexp
+}
+
+// schemaTypes can be given in JSON as either a string or a list of strings
+type schemaTypes []string
+
+func (t *schemaTypes) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*t = schemaTypes{single}
+		return nil
+	}
+	var multiple []string
+	if err := json.Unmarshal(data, &multiple); err != nil {
+		return fmt.Errorf("type should be a string or a list of strings: %w", err)
+	}
+	*t = multiple
+	return nil
+}
+
+// LoadSchema reads a schema from a JSON file
+func LoadSchema(path string) (*Schema, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read the schema: %w", err)
+	}
+	var result Schema
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, fmt.Errorf("cannot parse the schema: %w", err)
+	}
+	for name, property := range result.Properties {
+		for _, t := range property.Type {
+			if !slices.Contains([]string{"string", "number", "integer", "boolean", "array", "object", "null"}, t) {
+				return nil, fmt.Errorf("property %q of the schema has an unknown type %q", name, t)
+			}
+		}
+		if property.Pattern != "" {
+			if property.pattern, err = regexp.Compile(property.Pattern); err != nil {
+				return nil, fmt.Errorf("property %q of the schema has an invalid pattern: %w", name, err)
+			}
+		}
+	}
+	return &result, nil
+}
+
+// Validate returns an error describing the first problem with the record, if any
+func (s *Schema) Validate(args RenderArgs) error {
+	for _, name := range s.Required {
+		if _, ok := args[name]; !ok {
+			return fmt.Errorf("required field %q is missing", name)
+		}
+	}
+	for name, property := range s.Properties {
+		value, ok := args[name]
+		if !ok {
+			continue
+		}
+		if len(property.Type) > 0 && !slices.ContainsFunc(property.Type, func(t string) bool { return hasSchemaType(value, t) }) {
+			return fmt.Errorf("field %q should be of type %v", name, strings.Join(property.Type, " or "))
+		}
+		if property.pattern != nil && !property.pattern.MatchString(toString(value)) {
+			return fmt.Errorf("field %q does not match the pattern %q", name, property.Pattern)
+		}
+	}
+	return nil
+}
+
+func hasSchemaType(value any, t string) bool {
+	switch v := value.(type) {
+	case nil:
+		return t == "null"
+	case bool:
+		return t == "boolean"
+	case []any:
+		return t == "array"
+	case map[string]any:
+		return t == "object"
+	case json.Number:
+		if t == "integer" {
+			return !strings.ContainsAny(v.String(), ".eE")
+		}
+		return t == "number"
+	case string:
+		switch t {
+		case "string":
+			return true
+		case "integer":
+			_, err := strconv.ParseInt(v, 10, 64)
+			return err == nil
+		case "number":
+			_, err := strconv.ParseFloat(v, 64)
+			return err == nil
+		case "boolean":
+			_, err := strconv.ParseBool(v)
+			return err == nil
+		}
+	}
+	return false
+}
+
+// NewValidatingGenerator passes any records which do not
+// match the schema to the rejector, rather than yielding them.
+func NewValidatingGenerator(generator Generator, schema *Schema, rejects *Rejector) Generator {
+	return func(ctx context.Context, cancel context.CancelCauseFunc, in io.Reader) iter.Seq2[int, RenderArgs] {
+		return func(yield func(int, RenderArgs) bool) {
+			for lineNumber, args := range generator(ctx, cancel, in) {
+				if err := schema.Validate(args); err != nil {
+					rejects.RejectRecord(lineNumber, args, err)
+					continue
+				}
+				if !yield(lineNumber, args) {
+					return
+				}
+			}
+		}
+	}
+}
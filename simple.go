@@ -2,18 +2,69 @@ package dispatch
 
 import (
 	"context"
+	"fmt"
 	"io"
 	"iter"
+	"strconv"
 	"strings"
 )
 
-func SimpleLineGenerator(ctx context.Context, cancel context.CancelCauseFunc, in io.Reader) iter.Seq[RenderArgs] {
-	return func(yield func(RenderArgs) bool) {
-		for text := range LineReader(in, cancel) {
-			text = strings.TrimSpace(text)
-			if !yield(map[string]string{"value": text}) {
-				return
+func SimpleLineGenerator(ctx context.Context, cancel context.CancelCauseFunc, in io.Reader) iter.Seq2[int, RenderArgs] {
+	return NewSimpleLineGenerator('\n', true)(ctx, cancel, in)
+}
+
+// NewSimpleLineGenerator exposes each line as "value". Lines are terminated by
+// the delimiter, and have leading and trailing whitespace removed if trim is set.
+func NewSimpleLineGenerator(delimiter byte, trim bool) Generator {
+	return func(ctx context.Context, cancel context.CancelCauseFunc, in io.Reader) iter.Seq2[int, RenderArgs] {
+		return func(yield func(int, RenderArgs) bool) {
+			for lineNumber, text := range LineReader(in, delimiter, cancel) {
+				if trim {
+					text = strings.TrimSpace(text)
+				}
+				if !yield(lineNumber, RenderArgs{"value": text}) {
+					return
+				}
 			}
 		}
 	}
 }
+
+// NewSplitLineGenerator behaves like NewSimpleLineGenerator, but also splits each
+// line into fields, exposed as "f1", "f2", etc as well as the list "fields". If
+// separator is empty, fields are separated by any amount of whitespace. Otherwise,
+// lines are not trimmed, as leading and trailing fields may be empty. Fields can
+// also be given names, where the first name refers to the first field, and so on.
+func NewSplitLineGenerator(delimiter byte, trim bool, separator string, names []string) (Generator, error) {
+	for _, name := range names {
+		if name == "" || name == "value" || name == "fields" || strings.HasPrefix(name, "__") {
+			return nil, fmt.Errorf("%q cannot be used as a field name", name)
+		}
+	}
+	lines := NewSimpleLineGenerator(delimiter, trim && separator == "")
+	return func(ctx context.Context, cancel context.CancelCauseFunc, in io.Reader) iter.Seq2[int, RenderArgs] {
+		return func(yield func(int, RenderArgs) bool) {
+			for lineNumber, args := range lines(ctx, cancel, in) {
+				text := args["value"].(string)
+				var parts []string
+				if separator == "" {
+					parts = strings.Fields(text)
+				} else {
+					parts = strings.Split(text, separator)
+				}
+				fields := make([]any, len(parts))
+				for i, part := range parts {
+					fields[i] = part
+					args["f"+strconv.Itoa(i+1)] = part
+					if i < len(names) {
+						args[names[i]] = part
+					}
+				}
+				args["fields"] = fields
+				if !yield(lineNumber, args) {
+					return
+				}
+			}
+		}
+	}, nil
+}
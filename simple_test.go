@@ -0,0 +1,40 @@
+package dispatch
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestSplitLineGenerator(t *testing.T) {
+	generator, err := NewSplitLineGenerator('\n', true, "\t", []string{"first", "second"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := collectRecords(generator(context.Background(), nil, strings.NewReader("\tb\t\n a\tb \n")))
+	if len(records) != 2 {
+		t.Fatalf("expected 2 records, got %v", records)
+	}
+	// leading and trailing empty fields are kept, so the others do not move
+	if r := records[0]; r["f1"] != "" || r["f2"] != "b" || r["f3"] != "" || r["first"] != "" || r["second"] != "b" || len(r["fields"].([]any)) != 3 {
+		t.Errorf("expected the fields to keep their positions, got %v", r)
+	}
+	if r := records[1]; r["first"] != " a" || r["second"] != "b " || r["value"] != " a\tb " {
+		t.Errorf("expected the whitespace to be kept when a separator is given, got %v", r)
+	}
+
+	generator, err = NewSplitLineGenerator('\n', true, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records = collectRecords(generator(context.Background(), nil, strings.NewReader("  x   y \n")))
+	if r := records[0]; r["f1"] != "x" || r["f2"] != "y" || r["value"] != "x   y" {
+		t.Errorf("expected fields separated by whitespace, got %v", r)
+	}
+
+	for _, name := range []string{"value", "fields", "__index", ""} {
+		if _, err := NewSplitLineGenerator('\n', true, "", []string{name}); err == nil {
+			t.Errorf("expected %q to be refused as a field name", name)
+		}
+	}
+}
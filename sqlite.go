@@ -0,0 +1,232 @@
+package dispatch
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"iter"
+	"net/url"
+	"strconv"
+	"strings"
+	"text/template"
+	"text/template/parse"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// SQLiteSource generates records from the rows returned by a query,
+// and can acknowledge each job once it has succeeded.
+type SQLiteSource struct {
+	db    *sql.DB
+	query string
+	// buffer is set if the query's results must be read before any jobs start
+	buffer bool
+}
+
+// OpenSQLite opens the database at path. Unless writable is set, the database
+// is opened read-only. Otherwise, unless the database already uses write-ahead
+// logging, reading the query's results would prevent acknowledgements from being
+// written, so the results are read in full before any records are generated.
+func OpenSQLite(path string, query string, writable bool) (*SQLiteSource, error) {
+	parameters := url.Values{}
+	if writable {
+		parameters.Set("_busy_timeout", "10000")
+	} else {
+		parameters.Set("mode", "ro")
+	}
+	db, err := sql.Open("sqlite3", "file:"+strings.NewReplacer("%", "%25", "?", "%3f", "#", "%23").Replace(path)+"?"+parameters.Encode())
+	if err != nil {
+		return nil, fmt.Errorf("cannot open the SQLite database: %w", err)
+	}
+	if err := db.Ping(); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("cannot open the SQLite database: %w", err)
+	}
+	result := &SQLiteSource{db: db, query: query}
+	if writable {
+		var mode string
+		if err := db.QueryRow("PRAGMA journal_mode").Scan(&mode); err != nil {
+			_ = db.Close()
+			return nil, fmt.Errorf("cannot read the journal mode of the SQLite database: %w", err)
+		}
+		result.buffer = !strings.EqualFold(mode, "wal")
+	}
+	return result, nil
+}
+
+// Generator yields a record for each row returned by the query, with a field
+// for each column. Numbers are exposed in the same way as JSON numbers.
+// The input is ignored.
+func (s *SQLiteSource) Generator() Generator {
+	return func(ctx context.Context, cancel context.CancelCauseFunc, in io.Reader) iter.Seq2[int, RenderArgs] {
+		return func(yield func(int, RenderArgs) bool) {
+			rows, err := s.db.QueryContext(ctx, s.query)
+			if err != nil {
+				cancel(fmt.Errorf("cannot run the SQLite query: %w", err))
+				return
+			}
+			defer func() {
+				_ = rows.Close()
+			}()
+			columns, err := rows.Columns()
+			if err != nil {
+				cancel(fmt.Errorf("cannot read the columns of the SQLite query: %w", err))
+				return
+			}
+			values := make([]any, len(columns))
+			pointers := make([]any, len(columns))
+			for i := range values {
+				pointers[i] = &values[i]
+			}
+			var position int
+			var buffered []RenderArgs
+			for rows.Next() {
+				if err := rows.Scan(pointers...); err != nil {
+					cancel(fmt.Errorf("cannot read a row of the SQLite query: %w", err))
+					return
+				}
+				result := make(RenderArgs, len(columns))
+				for i, column := range columns {
+					switch v := values[i].(type) {
+					case []byte:
+						result[column] = string(v)
+					case int64:
+						result[column] = json.Number(strconv.FormatInt(v, 10))
+					case float64:
+						result[column] = json.Number(strconv.FormatFloat(v, 'g', -1, 64))
+					default:
+						result[column] = v
+					}
+				}
+				if s.buffer {
+					buffered = append(buffered, result)
+					continue
+				}
+				position++
+				if !yield(position, result) {
+					return
+				}
+			}
+			if err := rows.Err(); err != nil && ctx.Err() == nil {
+				cancel(fmt.Errorf("cannot read the results of the SQLite query: %w", err))
+				return
+			}
+			// the database can only be written to once the results have been read
+			_ = rows.Close()
+			for _, result := range buffered {
+				position++
+				if !yield(position, result) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// Acknowledge executes a statement, such as one marking a job as done,
+// with the values of its parameters
+func (s *SQLiteSource) Acknowledge(ctx context.Context, statement string, parameters ...any) error {
+	_, err := s.db.ExecContext(ctx, statement, parameters...)
+	return err
+}
+
+// sqlParameter is appended to every action in a statement template. Rather than
+// substituting the value into the SQL, it is replaced by ? and the value is bound
+// to that parameter, so it never needs to be quoted or escaped.
+const sqlParameter = "sqlParameter"
+
+// NewStatementTemplate parses a template for an SQL statement, in which every
+// substituted value becomes a bound parameter. It is rendered with RenderStatement.
+// Unlike NewTemplate, a missing value is not converted to text, becoming NULL.
+func NewStatementTemplate(name string, text string, missingKey string) (*template.Template, error) {
+	if missingKey == "" {
+		missingKey = "error"
+	}
+	t, err := template.New(name).Option("missingkey=" + missingKey).Funcs(TemplateFuncs).Funcs(template.FuncMap{sqlParameter: func(any) string { return "?" }}).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	parameterizeActions(t.Root)
+	return t, nil
+}
+
+// RenderStatement renders a template created by NewStatementTemplate, returning
+// the statement and the values of its parameters in order
+func RenderStatement(t *template.Template, args RenderArgs) (string, []any, error) {
+	// each rendering collects its own parameters
+	t, err := t.Clone()
+	if err != nil {
+		return "", nil, err
+	}
+	var parameters []any
+	t.Funcs(template.FuncMap{sqlParameter: func(v any) string {
+		parameters = append(parameters, sqlValue(v))
+		return "?"
+	}})
+	var sb strings.Builder
+	if err := t.Execute(&sb, args); err != nil {
+		return "", nil, err
+	}
+	return sb.String(), parameters, nil
+}
+
+// parameterizeActions makes every action which writes a value into a bound parameter.
+// As the value is not written into the statement, sqlQuote is no longer needed.
+func parameterizeActions(node parse.Node) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, child := range n.Nodes {
+			parameterizeActions(child)
+		}
+	case *parse.ActionNode:
+		if len(n.Pipe.Decl) > 0 {
+			// assignments do not produce any output
+			return
+		}
+		identifier := parse.NewIdentifier(sqlParameter).SetPos(n.Pos)
+		if last := n.Pipe.Cmds[len(n.Pipe.Cmds)-1]; len(last.Args) == 1 {
+			if quote, ok := last.Args[0].(*parse.IdentifierNode); ok && quote.Ident == "sqlQuote" {
+				last.Args[0] = identifier
+				return
+			}
+		}
+		n.Pipe.Cmds = append(n.Pipe.Cmds, &parse.CommandNode{NodeType: parse.NodeCommand, Pos: n.Pos, Args: []parse.Node{identifier}})
+	case *parse.IfNode:
+		parameterizeActions(n.List)
+		parameterizeActions(n.ElseList)
+	case *parse.RangeNode:
+		parameterizeActions(n.List)
+		parameterizeActions(n.ElseList)
+	case *parse.WithNode:
+		parameterizeActions(n.List)
+		parameterizeActions(n.ElseList)
+	}
+}
+
+// sqlValue converts a record value into one which can be bound to a parameter.
+// Numbers keep their type, so that they compare equal to the numbers in the database.
+func sqlValue(v any) any {
+	switch value := v.(type) {
+	case nil, string, bool, int64, float64:
+		return value
+	case json.Number:
+		if i, err := value.Int64(); err == nil {
+			return i
+		}
+		if f, err := value.Float64(); err == nil {
+			return f
+		}
+		return value.String()
+	default:
+		return toString(value)
+	}
+}
+
+func (s *SQLiteSource) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,85 @@
+package dispatch
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestRenderStatement(t *testing.T) {
+	for _, c := range []struct {
+		text       string
+		statement  string
+		parameters []any
+	}{
+		{"UPDATE jobs SET done = 1 WHERE id = {{.id}}", "UPDATE jobs SET done = 1 WHERE id = ?", []any{int64(7)}},
+		{"DELETE FROM jobs WHERE name = {{.name | sqlQuote}}", "DELETE FROM jobs WHERE name = ?", []any{"O'Brien'; DROP TABLE jobs; --"}},
+		{"UPDATE jobs SET score = {{.score}}{{if .name}}, name = {{.name}}{{end}}", "UPDATE jobs SET score = ?, name = ?", []any{1.5, "O'Brien'; DROP TABLE jobs; --"}},
+		{"{{$id := .id}}UPDATE jobs SET note = {{.missing}} WHERE id = {{$id}}", "UPDATE jobs SET note = ? WHERE id = ?", []any{nil, int64(7)}},
+	} {
+		statement, parameters, err := RenderStatement(Must(NewStatementTemplate("Ack", c.text, "zero")), RenderArgs{"id": json.Number("7"), "score": json.Number("1.5"), "name": "O'Brien'; DROP TABLE jobs; --"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if statement != c.statement || !reflect.DeepEqual(parameters, c.parameters) {
+			t.Errorf("expected %q to render as %q with %v, not %q with %v", c.text, c.statement, c.parameters, statement, parameters)
+		}
+	}
+}
+
+func TestSQLiteAcknowledge(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "work.db")
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Exec("CREATE TABLE jobs (id INTEGER, name TEXT, done INTEGER DEFAULT 0); INSERT INTO jobs (id, name) VALUES (1, 'plain'), (2, 'O''Brien'), (3, 'x''; DROP TABLE jobs; --')"); err != nil {
+		t.Fatal(err)
+	}
+
+	source, err := OpenSQLite(path, "SELECT id, name FROM jobs WHERE done = 0 ORDER BY id", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+	ack := Must(NewStatementTemplate("SQLiteAck", "UPDATE jobs SET done = 1 WHERE id = {{.id}} AND name = {{.name}}", "error"))
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+	var positions []int
+	for position, args := range source.Generator()(ctx, cancel, nil) {
+		positions = append(positions, position)
+		// acknowledge each record while the rest are still being generated
+		statement, parameters, err := RenderStatement(ack, args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := source.Acknowledge(ctx, statement, parameters...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := context.Cause(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(positions, []int{1, 2, 3}) {
+		t.Errorf("expected three records, numbered from 1, not %v", positions)
+	}
+	var done int
+	if err := db.QueryRow("SELECT COUNT(*) FROM jobs WHERE done = 1").Scan(&done); err != nil {
+		t.Fatal(err)
+	}
+	if done != 3 {
+		t.Errorf("expected every job to be acknowledged, not %v", done)
+	}
+	// opening the database must not change how it is journalled
+	var mode string
+	if err := db.QueryRow("PRAGMA journal_mode").Scan(&mode); err != nil {
+		t.Fatal(err)
+	}
+	if mode != "delete" {
+		t.Errorf("expected the journal mode to be left as delete, not %v", mode)
+	}
+}
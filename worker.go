@@ -8,11 +8,15 @@ import (
 	"fmt"
 	"io"
 	"log/slog"
+	"maps"
 	"os"
 	"os/exec"
+	"strconv"
+	"strings"
 	"sync/atomic"
 	"syscall"
 	"time"
+	"unicode/utf8"
 
 	"github.com/klauspost/compress/zstd"
 	"golang.org/x/time/rate"
@@ -24,25 +28,75 @@ var (
 )
 
 type PreparationOpts struct {
+	Axes                    []string  `long:"axis" description:"generate jobs for every combination of the values of each axis, given as name=a,b,c or name=@filename"`
+	BatchMaxBytes           int       `long:"batch-max-bytes" description:"when batching, limit the total length of the records' fields in each batch"`
+	BatchSize               int       `long:"batch-size" description:"group this many records into each job, exposed as .records and .values"`
+	CrossInput              bool      `long:"cross-input" description:"when using --axis, combine every record from STDIN with every combination of the axes"`
 	CSV                     bool      `long:"csv" description:"interpret STDIN as a CSV"`
+	CSVColumns              *string   `long:"csv-columns" description:"when using --csv, the file has no header row, and these are the comma-separated column names"`
+	CSVComment              *string   `long:"csv-comment" description:"when using --csv, ignore rows starting with this character"`
+	CSVDelimiter            *string   `long:"csv-delimiter" description:"when using --csv, fields are separated by this character (such as ; or \\t) rather than a comma"`
+	CSVLazyQuotes           bool      `long:"csv-lazy-quotes" description:"when using --csv, allow quotes to appear in unquoted fields, and unescaped in quoted fields"`
+	CSVRagged               string    `long:"csv-ragged" description:"when using --csv, what to do with rows which have the wrong number of columns" choice:"reject" choice:"pad" choice:"skip" choice:"error" default:"reject"`
+	CSVSkipRows             int       `long:"csv-skip-rows" description:"when using --csv, ignore this many lines before the header"`
 	DebounceFailuresPeriod  *Duration `long:"debounce-failures" description:"re-run failed jobs outside the debounce period, even if they would normally be skipped"`
 	DebounceSuccessesPeriod *Duration `long:"debounce-successes" description:"re-run successful jobs outside the debounce period, even if they would normally be skipped"`
+	Dedupe                  bool      `long:"dedupe" description:"only run one of any identical jobs (the default when skipping successes or failures)"`
 	DeferDelay              *Duration `long:"defer-delay" description:"when deferring reruns, wait some time before beginning processing"`
 	DeferReruns             bool      `long:"defer-reruns" description:"give priority to jobs which have not previously been run"`
+	Delimiter               *string   `long:"delimiter" description:"input records are terminated by this character (such as \\t) rather than a newline"`
+	Exclude                 []string  `long:"exclude" description:"when using --files, skip files and directories matching this glob"`
+	FieldNames              *string   `long:"field-names" description:"when splitting lines into fields, also expose them using these comma-separated names. Implies --split"`
+	FieldSeparator          *string   `long:"field-separator" description:"split each line into fields separated by this string (such as : or \\t), exposed as .f1, .f2, etc and .fields"`
+	Files                   []string  `long:"files" description:"generate a job for each file matching this glob, where ** matches any number of directories. Can be repeated"`
+	Follow                  bool      `long:"follow" description:"keep reading each --input-file as it grows (like tail -F), until interrupted"`
+	Hidden                  bool      `long:"hidden" description:"when using --files, include files and directories whose names start with a dot"`
+	InputFiles              []string  `long:"input-file" description:"read records from this file instead of STDIN (- means STDIN). Can be repeated"`
 	JsonLine                bool      `long:"json-line" description:"interpret STDIN as JSON objects, one per line"`
+	Link                    bool      `long:"link" description:"combine the nth record of every --input-file into a single record, rather than reading the files one after another"`
+	MissingKey              string    `long:"missing-key" description:"what to do when a record lacks a field used by a template" choice:"error" choice:"zero" choice:"default" default:"error"`
+	NoDedupe                bool      `long:"no-dedupe" description:"run identical jobs as many times as they appear"`
+	NoTrim                  bool      `long:"no-trim" description:"do not remove leading and trailing whitespace from each line"`
+	Null                    bool      `short:"0" long:"null" description:"input records are terminated by a NUL character rather than a newline, as produced by find -print0. Implies --no-trim"`
+	Preflight               string    `long:"preflight" description:"before starting, compare the fields used by the templates with the CSV header or the first records, and refuse to start (or only warn) if any are missing or unused" choice:"error" choice:"warn" choice:"off" default:"error"`
+	PreflightRecords        int       `long:"preflight-records" description:"the number of records to inspect when running the preflight check, if there is no CSV header" default:"10"`
+	Query                   *string   `long:"query" description:"when using --sqlite, the query which selects the records"`
+	Ranges                  []string  `long:"range" description:"generate a job for each number from START to END, given as START..END[:STEP], instead of reading STDIN. Can be repeated"`
+	RangeWidth              int       `long:"range-width" description:"zero-pad each number from --range to this many digits"`
+	Regex                   *string   `long:"regex" description:"interpret each line of STDIN using this regular expression, exposing its named capture groups"`
+	RejectFile              *string   `long:"reject-file" description:"write input which could not be turned into a job to this file, in the same format as the input"`
+	RequireFields           *string   `long:"require-fields" description:"reject records which lack any of these comma-separated fields"`
+	Schema                  *string   `long:"schema" description:"reject records which do not match this JSON schema file (supporting required, type and pattern)"`
 	Shuffle                 bool      `long:"shuffle" description:"disregard the order in which the jobs were given"`
+	Split                   bool      `long:"split" description:"split each line into whitespace-separated fields, exposed as .f1, .f2, etc and .fields"`
 	SkipFailures            bool      `long:"skip-failures" description:"skip jobs which have already been run unsuccessfully"`
 	SkipSuccesses           bool      `long:"skip-successes" description:"skip jobs which have already been run successfully"`
+	SQLite                  *string   `long:"sqlite" description:"generate a job for each row returned by --query from this SQLite database, instead of reading STDIN"`
+	SQLiteAck               *string   `long:"sqlite-ack" description:"when using --sqlite, execute this statement (a template, such as UPDATE jobs SET done=1 WHERE id={{.id}}) after each job succeeds"`
 }
 type ExecutionOpts struct {
 	AbortOnError        bool           `long:"abort-on-error" description:"stop running (as though CTRL-C were pressed) if a job fails"`
 	CacheLocation       *string        `long:"cache-location" description:"path (or S3 URI) to record successes and failures"`
+	CommandFile         *string        `long:"command-file" description:"render this file for each job and run it as a script, passing the command (if any) as its arguments"`
 	Concurrency         int            `long:"concurrency" description:"run this many jobs in dispatch" default:"1"`
 	DryRun              bool           `long:"dry-run" description:"simulate what would be run"`
+	Env                 []string       `long:"env" description:"set an environment variable for each job, given as KEY=template. Can be repeated"`
+	EnvFile             *string        `long:"env-file" description:"set the environment variables defined in this file, with one KEY=template per line"`
+	EnvFromRecord       *string        `long:"env-from-record" optional:"yes" optional-value:"DISPATCH_" description:"set an environment variable for each field of the record, named with this prefix (default: DISPATCH_)"`
 	Input               *string        `long:"input" description:"send the input string (plus newline) forever as STDIN to each job"`
+	KeepFailedTmp       bool           `long:"keep-failed-tmp" description:"when using --tmpdir, do not remove the temporary directory of a job which fails"`
+	Key                 *string        `long:"key" description:"identify each job using this template (such as {{.id}}) rather than the rendered command, when recording and skipping successes and failures"`
 	RateLimit           *time.Duration `long:"rate-limit" description:"prevent jobs starting more than this often"`
 	RateLimitBucketSize int            `long:"rate-limit-bucket-size" description:"allow a burst of up to this many jobs when enforcing the rate limit"`
+	Retries             int            `long:"retries" description:"run each job again, up to this many times, if it fails"`
+	RetryBackoff        Duration       `long:"retry-backoff" description:"wait this long before the first retry of a job, doubling the wait after each further attempt" default:"1s"`
+	RetryMaxDelay       Duration       `long:"retry-max-delay" description:"never wait longer than this before retrying a job" default:"1m"`
+	RetryOnExit         *string        `long:"retry-on-exit" description:"only retry jobs which fail with one of these comma-separated exit codes"`
+	RetryOnTimeout      bool           `long:"retry-on-timeout" description:"also retry jobs which time out"`
+	Shell               *string        `long:"shell" optional:"yes" optional-value:"sh" choice:"sh" choice:"bash" description:"join the command's arguments and run them with this shell (default: sh), shell-quoting every substituted value"`
 	Timeout             *Duration      `long:"timeout" description:"cancel each job after this much time"`
+	TmpDir              bool           `long:"tmpdir" description:"create a temporary directory for each job, available as {{.__tmpdir}} and $TMPDIR, and remove it afterwards"`
+	WorkDir             *string        `long:"workdir" description:"run each job in this directory (a template, such as {{.repo}})"`
 }
 
 type OutputOpts struct {
@@ -59,8 +113,115 @@ type Opts struct {
 	OutputOpts      `group:"output"`
 }
 
+// LineDelimiter returns the character which terminates each input record
+func (o Opts) LineDelimiter() (byte, error) {
+	if o.Null {
+		return 0, nil
+	}
+	if o.Delimiter == nil {
+		return '\n', nil
+	}
+	if len(*o.Delimiter) == 1 {
+		return (*o.Delimiter)[0], nil
+	}
+	// allow escape sequences such as \t or \xff
+	if d, err := strconv.Unquote(`"` + *o.Delimiter + `"`); err == nil && len(d) == 1 {
+		return d[0], nil
+	}
+	return 0, fmt.Errorf("the delimiter must be a single character, not %q", *o.Delimiter)
+}
+
+// CsvOptions returns how CSV input should be interpreted
+func (o Opts) CsvOptions() (CsvOptions, error) {
+	result := CsvOptions{LazyQuotes: o.CSVLazyQuotes, Ragged: o.CSVRagged, SkipRows: o.CSVSkipRows}
+	if o.CSVColumns != nil {
+		for column := range strings.SplitSeq(*o.CSVColumns, ",") {
+			result.Columns = append(result.Columns, strings.TrimSpace(column))
+		}
+	}
+	if o.CSVDelimiter != nil {
+		c, ok := parseCharacter(*o.CSVDelimiter)
+		if !ok {
+			return result, fmt.Errorf("the CSV delimiter must be a single character, not %q", *o.CSVDelimiter)
+		}
+		result.Comma = c
+	}
+	if o.CSVComment != nil {
+		c, ok := parseCharacter(*o.CSVComment)
+		if !ok {
+			return result, fmt.Errorf("the CSV comment must be a single character, not %q", *o.CSVComment)
+		}
+		result.Comment = c
+	}
+	if result.SkipRows < 0 {
+		return result, errors.New("the number of CSV rows to skip cannot be negative")
+	}
+	comma := result.Comma
+	if comma == 0 {
+		comma = ','
+	}
+	if !validCSVCharacter(comma) {
+		return result, fmt.Errorf("the CSV delimiter cannot be %q", comma)
+	}
+	if result.Comment != 0 && (!validCSVCharacter(result.Comment) || result.Comment == comma) {
+		return result, fmt.Errorf("the CSV comment cannot be %q", result.Comment)
+	}
+	return result, nil
+}
+
+// validCSVCharacter reports whether the character can be used as a CSV delimiter or comment
+func validCSVCharacter(c rune) bool {
+	return c != '"' && c != '\r' && c != '\n' && utf8.ValidRune(c) && c != utf8.RuneError
+}
+
+// parseCharacter interprets text as a single character, allowing escape sequences such as \t
+func parseCharacter(text string) (rune, bool) {
+	if r := []rune(text); len(r) == 1 {
+		return r[0], true
+	}
+	if s, err := strconv.Unquote(`"` + text + `"`); err == nil {
+		if r := []rune(s); len(r) == 1 {
+			return r[0], true
+		}
+	}
+	return 0, false
+}
+
+// SplitFields returns the separator used to split lines into fields, if
+// they should be split. An empty separator means any amount of whitespace.
+func (o Opts) SplitFields() (string, bool, error) {
+	if o.FieldSeparator == nil {
+		return "", o.Split || o.FieldNames != nil, nil
+	}
+	if *o.FieldSeparator == "" {
+		return "", false, errors.New("the field separator cannot be empty; use --split to separate fields by whitespace")
+	}
+	// allow escape sequences such as \t
+	if s, err := strconv.Unquote(`"` + *o.FieldSeparator + `"`); err == nil && s != "" {
+		return s, true, nil
+	}
+	return *o.FieldSeparator, true, nil
+}
+
+// Deduplicate reports whether identical jobs should only be run once.
+// This is the default when skipping, as otherwise identical jobs would
+// not be skipped, and would run concurrently.
+func (o Opts) Deduplicate() bool {
+	if o.NoDedupe {
+		return false
+	}
+	return o.Dedupe || o.SkipSuccesses || o.SkipFailures
+}
+
+// Marker identifies a job in the cache. If the job has a key, only the
+// key is used, otherwise everything which determines what the job does.
 func Marker(cmd RenderedCommand) string {
 	h := sha256.New()
+	if cmd.key != "" {
+		h.Write([]byte("key\x00"))
+		h.Write([]byte(cmd.key))
+		return fmt.Sprintf("%x.zstd", h.Sum(nil))
+	}
 	for _, arg := range cmd.command {
 		h.Write([]byte(arg))
 		h.Write([]byte("\t"))
@@ -68,13 +229,31 @@ func Marker(cmd RenderedCommand) string {
 	if cmd.input != "" {
 		h.Write([]byte(cmd.input))
 	}
+	for _, env := range cmd.env {
+		h.Write([]byte("\x00"))
+		h.Write([]byte(env))
+	}
+	if cmd.workdir != "" {
+		h.Write([]byte("\x00workdir\x00"))
+		h.Write([]byte(cmd.workdir))
+	}
+	if cmd.script != "" {
+		h.Write([]byte("\x00script\x00"))
+		h.Write([]byte(cmd.script))
+	}
 	return fmt.Sprintf("%x.zstd", h.Sum(nil))
 }
 
+// minimumThroughputWindow stops the throughput being exaggerated shortly after starting
+const minimumThroughputWindow = time.Minute
+
 type Stats struct {
 	Queued     atomic.Int64
 	Skipped    atomic.Int64
+	Duplicates atomic.Int64
+	Rejected   atomic.Int64
 	InProgress atomic.Int64
+	Retrying   atomic.Int64
 	Succeeded  atomic.Int64
 	Failed     atomic.Int64
 	Aborted    atomic.Int64
@@ -83,8 +262,9 @@ type Stats struct {
 	Total          atomic.Int64
 	queueEmptyTime time.Time
 
-	since time.Time
-	etc   *etc
+	since     time.Time
+	etc       *etc
+	following bool
 }
 
 func (s *Stats) ZeroQueued() int64 {
@@ -124,6 +304,34 @@ func (s *Stats) AddAborted(d time.Duration) {
 	s.SetDirty()
 }
 
+// AddRenderFailed records a job which failed before it could be started,
+// because its command could not be rendered.
+func (s *Stats) AddRenderFailed() {
+	s.Failed.Add(1)
+	s.Total.Add(1)
+	s.SetDirty()
+}
+
+// AddRetrying records a job which has failed, and is waiting to be run again
+func (s *Stats) AddRetrying(d time.Duration) {
+	s.Retrying.Add(1)
+	s.InProgress.Add(-1)
+	s.etc.AddFailure(d)
+	s.SetDirty()
+}
+
+// SubRetrying records a job which is no longer waiting to be run again,
+// either because it has been queued, or because it was given up on
+func (s *Stats) SubRetrying(requeued bool) {
+	s.Retrying.Add(-1)
+	if requeued {
+		s.AddQueued()
+	} else {
+		s.Failed.Add(1)
+		s.SetDirty()
+	}
+}
+
 func (s *Stats) AddFailed(d time.Duration) {
 	s.Failed.Add(1)
 	s.InProgress.Add(-1)
@@ -155,7 +363,15 @@ func (s *Stats) String() string {
 	}
 	var etaPart string
 	var skippedPart string
-	if etaString == "" {
+	var rejectedPart string
+	var duplicatesPart string
+	var retryingPart string
+	if s.following {
+		completed := s.Succeeded.Load() + s.Failed.Load() + s.Aborted.Load()
+		// until a reasonable time has passed, the throughput is measured over a minimum window
+		window := max(time.Since(s.since), minimumThroughputWindow)
+		etaPart = fmt.Sprintf("Throughput: %.1f jobs/minute", float64(completed)/window.Minutes())
+	} else if etaString == "" {
 		etaPart = fmt.Sprintf("Elapsed time: %v", time.Since(s.since).Round(time.Second))
 	} else {
 		etaPart = fmt.Sprintf("Estimated time remaining: %v", etaString)
@@ -163,20 +379,47 @@ func (s *Stats) String() string {
 	if skipped := s.Skipped.Load(); skipped > 0 {
 		skippedPart = fmt.Sprintf(" (+%v skipped)", skipped)
 	}
+	if retrying := s.Retrying.Load(); retrying > 0 {
+		retryingPart = fmt.Sprintf(" Retrying: %v;", retrying)
+	}
+	if duplicates := s.Duplicates.Load(); duplicates > 0 {
+		duplicatesPart = fmt.Sprintf(" (+%v duplicates)", duplicates)
+	}
+	if rejected := s.Rejected.Load(); rejected > 0 {
+		rejectedPart = fmt.Sprintf(" (+%v rejected)", rejected)
+	}
 
-	return fmt.Sprintf("Queued: %v; In progress: %v; Succeeded: %v; Failed: %v; Aborted: %v; Total: %v%v; %v",
+	return fmt.Sprintf("Queued: %v; In progress: %v;%v Succeeded: %v; Failed: %v; Aborted: %v; Total: %v%v%v%v; %v",
 		s.Queued.Load(),
 		s.InProgress.Load(),
+		retryingPart,
 		s.Succeeded.Load(),
 		s.Failed.Load(),
 		s.Aborted.Load(),
 		s.Total.Load(),
 		skippedPart,
+		duplicatesPart,
+		rejectedPart,
 		etaPart,
 	)
 }
 
-func Worker(ctx context.Context, opts Opts, signaller <-chan os.Signal, cancel context.CancelCauseFunc, ch <-chan RenderedCommand, cache Cache, stats *Stats, limiter *rate.Limiter) {
+// writeScript saves a job's script to an executable temporary file, returning its path
+func writeScript(script string) (string, error) {
+	f, err := os.CreateTemp("", "dispatch-*.script")
+	if err != nil {
+		return "", fmt.Errorf("could not create the job's script: %w", err)
+	}
+	_, err = f.WriteString(script)
+	err = errors.Join(err, f.Chmod(0o700), f.Close())
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return "", fmt.Errorf("could not write the job's script: %w", err)
+	}
+	return f.Name(), nil
+}
+
+func Worker(ctx context.Context, opts Opts, signaller <-chan os.Signal, cancel context.CancelCauseFunc, ch <-chan RenderedCommand, cache Cache, stats *Stats, limiter *rate.Limiter, locks *keyedMutex, retries *retryQueue, slot int, runID string) {
 	var ok bool
 	var command RenderedCommand
 	var cmd *exec.Cmd
@@ -221,52 +464,148 @@ func Worker(ctx context.Context, opts Opts, signaller <-chan os.Signal, cancel c
 				return
 			}
 		}
+		marker := Marker(command)
+		runtime := map[string]string{
+			slotField:      strconv.Itoa(slot),
+			runIDField:     runID,
+			markerField:    marker,
+			startTimeField: time.Now().Format(time.RFC3339),
+		}
+		if opts.TmpDir {
+			dir, err := os.MkdirTemp("", "dispatch-")
+			if err != nil {
+				cancel(fmt.Errorf("could not create a temporary directory for the job: %w", err))
+				return
+			}
+			runtime[tmpdirField] = dir
+		}
 		timer := time.Now()
 		logger.Debug("about to execute", slog.Any("command", command))
-		var subCancel context.CancelFunc
-		subCtx := context.Background()
-		if opts.Timeout != nil {
-			subCtx, subCancel = context.WithTimeout(subCtx, time.Duration(*opts.Timeout))
+		if stats != nil {
+			stats.InProgress.Add(1)
+			stats.SubQueued()
 		}
-		cmd = exec.CommandContext(subCtx, command.command[0], command.command[1:]...)
 
-		// launch as new process group so that signals (ex: SIGINT) are not sent also the the child process
-		createNewProcessGroup(cmd)
+		// run executes the command, returning it with its runtime fields substituted,
+		// and reporting whether any failure was due to the job itself, rather than the
+		// context being cancelled, and whether it timed out
+		run := func() (job RenderedCommand, output string, realFailure bool, timedOut bool, err error) {
+			values := maps.Clone(runtime)
+			values[attemptField] = strconv.Itoa(command.attempts + 1)
+			if command.script != "" {
+				path, err := writeScript(command.withRuntime(values).script)
+				if err != nil {
+					return command, "", true, false, err
+				}
+				defer func() {
+					_ = os.Remove(path)
+				}()
+				values[scriptField] = path
+			}
+			job = command.withRuntime(values)
+			var subCancel context.CancelFunc
+			subCtx := context.Background()
+			if command.timeout != nil {
+				subCtx, subCancel = context.WithTimeout(subCtx, *command.timeout)
+			} else if opts.Timeout != nil {
+				subCtx, subCancel = context.WithTimeout(subCtx, time.Duration(*opts.Timeout))
+			}
+			if subCancel != nil {
+				defer subCancel()
+			}
+			if job.workdir != "" {
+				if info, err := os.Stat(job.workdir); err != nil || !info.IsDir() {
+					return job, "", true, false, fmt.Errorf("the working directory %q does not exist", job.workdir)
+				}
+			}
+			cmd = exec.CommandContext(subCtx, job.command[0], job.command[1:]...)
+			cmd.Dir = job.workdir
+
+			// launch as new process group so that signals (ex: SIGINT) are not sent also the the child process
+			createNewProcessGroup(cmd)
 
-		if command.input != "" {
-			cmd.Stdin = Yes{Line: []byte(fmt.Sprintf("%v\n", command.input))}
-		}
-		marker := Marker(command)
+			if len(job.env) > 0 || opts.TmpDir {
+				cmd.Env = append(os.Environ(), job.env...)
+				if dir, ok := runtime[tmpdirField]; ok {
+					cmd.Env = append(cmd.Env, "TMPDIR="+dir)
+				}
+			}
+			if job.input != "" {
+				cmd.Stdin = Yes{Line: []byte(fmt.Sprintf("%v\n", job.input))}
+			}
 
-		var buffer bytes.Buffer
-		enc := Must(zstd.NewWriter(&buffer))
-		stdoutWriters := make([]io.Writer, 0, 2)
-		stderrWriters := make([]io.Writer, 0, 2)
-		stdoutWriters = append(stdoutWriters, enc)
-		stderrWriters = append(stderrWriters, enc)
-		if opts.ShowStderr {
-			stderrWriters = append(stderrWriters, os.Stderr)
+			var buffer bytes.Buffer
+			enc := Must(zstd.NewWriter(&buffer))
+			stdoutWriters := make([]io.Writer, 0, 2)
+			stderrWriters := make([]io.Writer, 0, 2)
+			stdoutWriters = append(stdoutWriters, enc)
+			stderrWriters = append(stderrWriters, enc)
+			if opts.ShowStderr {
+				stderrWriters = append(stderrWriters, os.Stderr)
+			}
+			if opts.ShowStdout {
+				stdoutWriters = append(stdoutWriters, os.Stdout)
+			}
+			cmd.Stdout = io.MultiWriter(stdoutWriters...)
+			cmd.Stderr = io.MultiWriter(stderrWriters...)
+			if opts.DryRun {
+				err = Sleep(ctx, time.Second)
+				buffer.Write([]byte("(dry run)"))
+			} else {
+				err = cmd.Run()
+				Must0(enc.Close())
+			}
+			cmd = nil
+			// Remember that a timeout counts as a real failure
+			timedOut = errors.Is(subCtx.Err(), context.DeadlineExceeded)
+			realFailure = subCtx.Err() == nil || timedOut
+			return job, buffer.String(), realFailure, timedOut, err
 		}
-		if opts.ShowStdout {
-			stdoutWriters = append(stdoutWriters, os.Stdout)
+
+		job, output, realFailure, timedOut, err := run()
+		if job.key != "" && !opts.DryRun && (err == nil || realFailure) {
+			// the marker no longer describes the command, so record it alongside the output
+			if err := cache.WriteDescription(context.WithoutCancel(ctx), marker, []byte(job.LogValue().String())); err != nil {
+				logger.Warn("could not record the description of the job", slog.String("output ID", marker), slog.Any("error", err))
+			}
 		}
-		cmd.Stdout = io.MultiWriter(stdoutWriters...)
-		cmd.Stderr = io.MultiWriter(stderrWriters...)
-		if stats != nil {
-			stats.InProgress.Add(1)
-			stats.SubQueued()
+		if command.concurrencyKey != "" {
+			// the sorter took the key before passing the job to this worker
+			locks.Unlock(command.concurrencyKey)
 		}
-		var err error
-		if opts.DryRun {
-			err = Sleep(ctx, time.Second)
-			buffer.Write([]byte("(dry run)"))
-		} else {
-			err = cmd.Run()
-			Must0(enc.Close())
+		retry := retries != nil && err != nil && realFailure && command.attempts < command.retries && ctx.Err() == nil && retries.Retryable(err, timedOut)
+		if dir, ok := runtime[tmpdirField]; ok {
+			if err != nil && realFailure && !retry && opts.KeepFailedTmp {
+				logger.Warn("keeping the temporary directory of the failed job", slog.String("path", dir), slog.Any("command", command))
+			} else if err := os.RemoveAll(dir); err != nil {
+				logger.Warn("could not remove the temporary directory of the job", slog.String("path", dir), slog.Any("error", err))
+			}
 		}
-		cmd = nil
 		elapsed := time.Since(timer)
-		output := buffer.String()
+		if retry {
+			// requeue the job, rather than waiting here, so other jobs can run meanwhile
+			delay := retries.Delay(command.attempts + 1)
+			if stats != nil {
+				stats.AddRetrying(elapsed)
+			}
+			if !opts.HideFailures {
+				logger.Warn("Failure, will retry", slog.String("elapsed", FriendlyDuration(elapsed)), slog.Int("attempt", command.attempts+1), slog.Int("retries", command.retries), slog.String("delay", FriendlyDuration(delay)), slog.Any("command", command), slog.Any("error", err))
+			}
+			next := command
+			next.attempts++
+			retries.Retry(ctx, next, delay, func(requeued bool) {
+				if stats != nil {
+					stats.SubRetrying(requeued)
+				}
+				// otherwise this was the final attempt, as the job cannot be retried after cancellation
+				if !requeued && !opts.DryRun {
+					if err := cache.WriteFailure(context.WithoutCancel(ctx), marker, []byte(output)); err != nil {
+						logger.Error("could not mark command as failed", slog.Any("error", err))
+					}
+				}
+			})
+			continue
+		}
 		if err == nil {
 			stats.AddSucceeded(elapsed)
 			if !opts.HideSuccesses {
@@ -276,11 +615,15 @@ func Worker(ctx context.Context, opts Opts, signaller <-chan os.Signal, cancel c
 				if err = cache.WriteSuccess(ctx, marker, []byte(output)); err != nil {
 					cancel(fmt.Errorf("could not mark command as successful: %w", err))
 				}
+				if command.acknowledge != nil {
+					if err := command.acknowledge(ctx, job.ack, job.ackParameters...); err != nil {
+						logger.Error("could not acknowledge the successful job", slog.String("statement", job.ack), slog.Any("parameters", job.ackParameters), slog.Any("error", err))
+					}
+				}
 			}
 		} else {
 			// the job has failed - but is it because we chose to cancel before it was done,
-			// or because the job actually failed? Remember that a timeout counts as a real failure
-			realFailure := subCtx.Err() == nil || errors.Is(subCtx.Err(), context.DeadlineExceeded)
+			// or because the job actually failed?
 			if realFailure {
 				if stats != nil {
 					stats.AddFailed(elapsed)
@@ -304,8 +647,6 @@ func Worker(ctx context.Context, opts Opts, signaller <-chan os.Signal, cancel c
 				cancel(errors.New("nonzero exit code"))
 			}
 		}
-		if subCancel != nil {
-			subCancel()
-		}
+		retries.Done()
 	}
 }
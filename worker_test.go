@@ -0,0 +1,152 @@
+package dispatch
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// runJobs renders each record with the template and runs it with a single worker
+func runJobs(t *testing.T, opts Opts, jobTemplate CommandTemplate, records ...RenderArgs) (*Stats, Cache, []RenderedCommand) {
+	t.Helper()
+	SetLogger(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	stats := NewStats(1, 0)
+	cache := NewFileCache(t.TempDir())
+	ch := make(chan RenderedCommand, len(records))
+	var commands []RenderedCommand
+	for _, args := range records {
+		command, err := jobTemplate.Render(args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stats.AddQueued()
+		ch <- command
+		commands = append(commands, command)
+	}
+	close(ch)
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+	Worker(ctx, opts, nil, cancel, ch, cache, stats, nil, nil, nil, 1, "run")
+	if err := context.Cause(ctx); err != nil {
+		t.Fatal(err)
+	}
+	return stats, cache, commands
+}
+
+func TestWorkerMissingWorkDir(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the job runs true")
+	}
+	jobTemplate := CommandTemplate{
+		Command: Must(ParseCommandline([]string{"true"}, "error")),
+		WorkDir: Must(NewTemplate("WorkDir", "{{.dir}}", "error")),
+	}
+	missing := filepath.Join(t.TempDir(), "missing")
+	stats, cache, commands := runJobs(t, Opts{}, jobTemplate, RenderArgs{"dir": missing}, RenderArgs{"dir": t.TempDir()})
+	if failed, succeeded := stats.Failed.Load(), stats.Succeeded.Load(); failed != 1 || succeeded != 1 {
+		t.Errorf("expected only the job with the missing directory to fail, not %v failures and %v successes", failed, succeeded)
+	}
+	if _, err := cache.FailureModTime(context.Background(), Marker(commands[0])); err != nil {
+		t.Errorf("expected the failure to be recorded: %v", err)
+	}
+}
+
+func TestWorkerKeyDescription(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the job runs echo")
+	}
+	jobTemplate := CommandTemplate{
+		Command: Must(ParseCommandline([]string{"echo", "{{.id}}"}, "error")),
+		Key:     Must(NewTemplate("Key", "order-{{.id}}", "error")),
+	}
+	_, cache, commands := runJobs(t, Opts{}, jobTemplate, RenderArgs{"id": "7"})
+	marker := Marker(commands[0])
+	compressed, err := cache.ReadSuccess(context.Background(), marker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoder := Must(zstd.NewReader(bytes.NewReader(compressed)))
+	defer decoder.Close()
+	// the output holds only what the job wrote
+	if output, err := io.ReadAll(decoder); err != nil || string(output) != "7\n" {
+		t.Errorf("expected the output to be the job's alone, not %q (%v)", output, err)
+	}
+	description, err := cache.ReadDescription(context.Background(), marker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "{command:[echo 7] input: key:order-7}"; string(description) != expected {
+		t.Errorf("expected the description %q, not %q", expected, description)
+	}
+}
+
+func TestWorkerTmpDir(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the job is run by sh")
+	}
+	out := t.TempDir()
+	jobTemplate := CommandTemplate{
+		Command: Must(ParseCommandline([]string{"sh", "-c", `printf %s "$TMPDIR" > {{.out}} && test "$TMPDIR" = {{.__tmpdir}} && touch {{.__tmpdir}}/file && exit {{.code}}`}, "error")),
+	}
+	for _, c := range []struct {
+		code string
+		keep bool
+		kept bool
+	}{
+		{"0", false, false},
+		{"1", false, false},
+		{"0", true, false},
+		{"1", true, true},
+	} {
+		var opts Opts
+		opts.TmpDir = true
+		opts.KeepFailedTmp = c.keep
+		path := filepath.Join(out, "tmpdir")
+		stats, _, _ := runJobs(t, opts, jobTemplate, RenderArgs{"out": path, "code": c.code, tmpdirField: runtimePlaceholder(tmpdirField)})
+		if failed := stats.Failed.Load(); (failed == 1) != (c.code == "1") {
+			t.Errorf("expected %v failures of the job exiting with %v, not %v", c.code, c.code, failed)
+		}
+		dir, err := os.ReadFile(path)
+		if err != nil || len(dir) == 0 {
+			t.Fatalf("expected the job to see TMPDIR: %v", err)
+		}
+		_, err = os.Stat(filepath.Join(string(dir), "file"))
+		if kept := err == nil; kept != c.kept {
+			t.Errorf("expected the temporary directory of a job exiting with %v and --keep-failed-tmp=%v to be kept: %v, not %v", c.code, c.keep, c.kept, kept)
+		}
+		if err := os.RemoveAll(string(dir)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestFollowingThroughput(t *testing.T) {
+	stats := NewStats(1, 0)
+	stats.following = true
+	stats.Succeeded.Add(3)
+	// shortly after starting, the throughput is measured over the minimum window
+	if s := stats.String(); !strings.Contains(s, "Throughput: 3.0 jobs/minute") {
+		t.Errorf("expected the throughput to be measured over a minute, got %q", s)
+	}
+}
+
+func TestLineDelimiter(t *testing.T) {
+	for given, expected := range map[string]byte{";": ';', `\t`: '\t', `\xff`: 0xff, `\x00`: 0} {
+		if d, err := (Opts{PreparationOpts: PreparationOpts{Delimiter: &given}}).LineDelimiter(); err != nil || d != expected {
+			t.Errorf("expected %q to be the byte %#x, got %#x (%v)", given, expected, d, err)
+		}
+	}
+	for _, given := range []string{"ab", `\u00e9`, ""} {
+		if _, err := (Opts{PreparationOpts: PreparationOpts{Delimiter: &given}}).LineDelimiter(); err == nil {
+			t.Errorf("expected %q to be refused as a delimiter", given)
+		}
+	}
+}